@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
@@ -27,7 +28,38 @@ var (
 	proxyAddr    = flag.String("proxy_addr", "0.0.0.0:2182", "proxy address")
 	cpuNum       = flag.Int("cpu_num", 1, "max cpu num")
 	ipAcl        = flag.Bool("ip_acl", false, "enable ip acl for zk path")
-	limitNum     = flag.Int("limit_num", -1, "limit num for request rate")
+	aclResync    = flag.Int("acl_resync", 300, "full resync interval of ip acl cache in seconds")
+	aclShadow    = flag.Bool("acl_shadow", false, "only log and count ip acl denials, still forward the requests")
+	aclFilter    = flag.String("acl_filter_paths", "/", "paths whose children are filtered by ip acl: /,/dubbo")
+	aclFile      = flag.String("acl_file", "", "load ip acl from a json or yaml file instead of zk, reload on change or SIGHUP")
+	authFile     = flag.String("auth_file", "", "json file of zk credentials added to the server connection by client ip or cidr")
+	aclPolicy    = flag.String("acl_policy_file", "", "json file of policies for acls set by create and setAcl")
+	sessionGuard = flag.Bool("session_guard", false, "remember the client ip which created each session and log reconnects from another ip")
+	guardReject  = flag.Bool("session_guard_reject", false, "refuse session reconnects from another ip, needs session_guard")
+	sessionRate  = flag.Int("session_rate", 0, "max new session handshakes per second, reconnects of existing sessions go first")
+	sessionQueue = flag.Int("session_queue", 1000, "max session handshakes waiting for session_rate")
+	sessionWait  = flag.Int("session_queue_timeout", 5, "seconds a session handshake waits for session_rate")
+	schedFile    = flag.String("sched_file", "", "json file of the weighted fair scheduler of requests to the zk servers")
+	brkLatency   = flag.Int("breaker_latency", 0, "response time in ms over which a zk server request is slow, 0 disables the backend breaker")
+	brkRatio     = flag.Float64("breaker_ratio", 0.5, "ratio of slow or failed requests opening the breaker of a zk server")
+	brkMin       = flag.Int("breaker_min", 20, "min requests in a window before the breaker of a zk server may open")
+	brkWindow    = flag.Int("breaker_window", 10, "seconds of the window the breaker of a zk server is judged on")
+	brkCooldown  = flag.Int("breaker_cooldown", 30, "seconds a zk server gets no new sessions after its breaker opened")
+	brkProbes    = flag.Int("breaker_probes", 1, "new sessions per window a zk server gets while its breaker is half-open")
+	brkMigrate   = flag.Bool("breaker_migrate", false, "close the sessions of a zk server when its breaker opens so clients reconnect elsewhere")
+	brkMigRate   = flag.Int("breaker_migrate_rate", 100, "sessions per second closed by breaker_migrate, 0 closes all at once")
+	reqTimeout   = flag.Int("request_timeout", 0, "ms the zk server has to answer a request before the proxy answers it with a timeout, 0 is no limit")
+	reqTimeouts  = flag.String("request_timeout_ops", "", "request timeout in ms of some ops: Get=500,Create=2000")
+	outBuffer    = flag.Int64("out_buffer", 0, "max bytes of responses queued for a slow client, 0 sends directly")
+	outBudget    = flag.Int64("out_budget", 256<<20, "max bytes of responses queued for all clients, once full slow_policy applies to the client with the longest queue")
+	slowPolicy   = flag.String("slow_policy", "disconnect", "policy for clients over out_buffer: disconnect, drop_watch or expire")
+	stormEvents  = flag.Int("storm_threshold", 0, "watch events per second on a path after which its reads are shared across sessions, 0 disables")
+	stormHold    = flag.Int("storm_hold", 5, "seconds a path with a watch storm keeps its reads shared")
+	stormShare   = flag.Int("storm_share", 100, "ms a shared read of a path with a watch storm is reused")
+	limitNum     = flag.Int("limit_num", -1, "limit num for request rate of the whole proxy")
+	limitReject  = flag.Int("limit_reject_code", 0, "answer requests over the limit with this zk error code instead of waiting, -7 for operation timeout")
+	quotaScan    = flag.Int("quota_scan", 60, "seconds between node counts of the namespaces with max_nodes in limit_file, each count lists every node of them")
+	limitFile    = flag.String("limit_file", "", "json file of global, per client, per path, per op class and per namespace request rates and write quotas, counted by each proxy in memory, reload on SIGHUP")
 	version      = flag.Bool("version", false, "show proxy version")
 )
 
@@ -51,17 +83,92 @@ func main() {
 	}
 	ctx, cancle := context.WithCancel(context.Background())
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
 	go stopProc(cancle, c)
 
 	go zk.StartHttp(*httpAddr)
-	if *ipAcl {
+	if len(*aclFile) > 0 || len(*limitFile) > 0 {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reloadConfig(hup)
+	} else {
+		signal.Notify(c, syscall.SIGHUP)
+	}
+	if len(*aclFile) > 0 {
+		zk.InitFileAcl(*aclFile)
+	}
+	if *ipAcl && len(*aclFile) == 0 {
+		if *aclResync > 0 {
+			zk.SetAclResyncInterval(*aclResync)
+		}
 		zk.InitAcl(zk.GetZkServers(*backendAddrs))
 	}
+	if *aclShadow {
+		zk.SetAclShadow()
+	}
+	zk.SetAclFilterPaths(strings.Split(*aclFilter, ","))
+	if len(*authFile) > 0 {
+		if err = zk.InitDigestAuth(*authFile); err != nil {
+			panic(err)
+		}
+	}
+	if len(*aclPolicy) > 0 {
+		if err = zk.InitAclPolicy(*aclPolicy); err != nil {
+			panic(err)
+		}
+	}
+	if *sessionGuard {
+		zk.InitSessionGuard(zk.GetZkServers(*backendAddrs), *guardReject)
+	}
+	if len(*schedFile) > 0 {
+		if err = zk.InitScheduler(*schedFile); err != nil {
+			panic(err)
+		}
+	}
+	if *brkLatency > 0 {
+		zk.SetBreaker(zk.BreakerConfig{
+			Latency:     time.Duration(*brkLatency) * time.Millisecond,
+			Ratio:       *brkRatio,
+			MinRequests: *brkMin,
+			Window:      time.Duration(*brkWindow) * time.Second,
+			Cooldown:    time.Duration(*brkCooldown) * time.Second,
+			Probes:      *brkProbes,
+			Migrate:     *brkMigrate,
+			MigrateRate: *brkMigRate,
+		})
+	}
+	if *reqTimeout > 0 || len(*reqTimeouts) > 0 {
+		if err = zk.SetRequestTimeout(*reqTimeout, *reqTimeouts); err != nil {
+			panic(err)
+		}
+	}
+	if *outBuffer > 0 {
+		if err = zk.SetOutputBuffer(*outBuffer, *outBudget, *slowPolicy); err != nil {
+			panic(err)
+		}
+	}
+	if *stormEvents > 0 {
+		zk.InitStormDampening(zk.GetZkServers(*backendAddrs), *stormEvents,
+			time.Duration(*stormHold)*time.Second, time.Duration(*stormShare)*time.Millisecond)
+	}
+	if *sessionRate > 0 {
+		zk.InitAdmission(*sessionRate, *sessionQueue, time.Duration(*sessionWait)*time.Second)
+	}
 	if *limitNum > 0 {
 		zk.SetLimit(*limitNum)
 	}
+	if *limitReject < 0 {
+		zk.SetLimitReject(*limitReject)
+	}
+	if len(*limitFile) > 0 {
+		if err = zk.InitLimit(*limitFile); err != nil {
+			panic(err)
+		}
+		if *quotaScan > 0 {
+			zk.InitNodeQuota(zk.GetZkServers(*backendAddrs), time.Duration(*quotaScan)*time.Second)
+		}
+	}
 	// go cpuProfile()
 	// go heapProfile()
 
@@ -87,6 +194,21 @@ func stopProc(cancle context.CancelFunc, c chan os.Signal) {
 	os.Exit(0)
 }
 
+func reloadConfig(c chan os.Signal) {
+	for range c {
+		if len(*aclFile) > 0 {
+			if err := zk.ReloadAclFile(); err != nil {
+				fmt.Printf("reload acl file %s failed: %v\n", *aclFile, err)
+			}
+		}
+		if len(*limitFile) > 0 {
+			if err := zk.ReloadLimit(); err != nil {
+				fmt.Printf("reload limit file %s failed: %v\n", *limitFile, err)
+			}
+		}
+	}
+}
+
 func showVersion() {
 	fmt.Println("buildstamp: " + buildstamp)
 	fmt.Println("githash: " + githash)
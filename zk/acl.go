@@ -3,6 +3,7 @@ package zk
 import (
 	"encoding/json"
 	"errors"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -11,18 +12,269 @@ import (
 	"github.com/samuel/go-zookeeper/zk"
 )
 
+// aclEntry is the whitelist attached to one zk path. The entry is stored as
+// json in the node permRoot+path, so entries nest the same way zk nodes do.
+// An inherited entry extends the whitelist of its nearest ancestor entry,
+// an overriding one replaces it. Denied ips are refused on the path and
+// everything below it whatever the whitelists say, and the entry of "/"
+// only carries denies. Expires and Deny hold unix seconds, 0 never expires.
+type aclEntry struct {
+	Inherit bool                `json:"inherit"`
+	Ips     map[string]aclPerms `json:"ips"`
+	Expires map[string]int64    `json:"expires,omitempty"`
+	Deny    map[string]int64    `json:"deny,omitempty"`
+}
+
+func (e *aclEntry) clone() *aclEntry {
+	if e == nil {
+		return nil
+	}
+	c := &aclEntry{Inherit: e.Inherit, Ips: make(map[string]aclPerms, len(e.Ips))}
+	for ip, perms := range e.Ips {
+		c.Ips[ip] = perms
+	}
+	if len(e.Expires) > 0 {
+		c.Expires = make(map[string]int64, len(e.Expires))
+		for ip, expire := range e.Expires {
+			c.Expires[ip] = expire
+		}
+	}
+	if len(e.Deny) > 0 {
+		c.Deny = make(map[string]int64, len(e.Deny))
+		for ip, expire := range e.Deny {
+			c.Deny[ip] = expire
+		}
+	}
+	return c
+}
+
+func expired(expire, now int64) bool {
+	return expire > 0 && expire <= now
+}
+
+func (e *aclEntry) grants(ipaddr string, perm int32, now int64) bool {
+	perms, ok := e.Ips[ipaddr]
+	if !ok || expired(e.Expires[ipaddr], now) {
+		return false
+	}
+	return int32(perms)&perm == perm
+}
+
+func (e *aclEntry) denies(ipaddr string, now int64) bool {
+	expire, ok := e.Deny[ipaddr]
+	return ok && !expired(expire, now)
+}
+
+// prune drops the grants and denies which have expired.
+func (e *aclEntry) prune(now int64) {
+	for ip, expire := range e.Expires {
+		if expired(expire, now) {
+			delete(e.Ips, ip)
+			delete(e.Expires, ip)
+		} else if _, ok := e.Ips[ip]; !ok {
+			delete(e.Expires, ip)
+		}
+	}
+	for ip, expire := range e.Deny {
+		if expired(expire, now) {
+			delete(e.Deny, ip)
+		}
+	}
+}
+
+// expireAt converts a ttl to the unix seconds stored in an entry.
+func expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).Unix()
+}
+
+// aclPerms is the set of Perm* bits granted to one ip. Entries written before
+// per-operation permissions existed store a bool, which means all or nothing.
+// Hand written acl files may also use zkCli letters such as "rw".
+type aclPerms int32
+
+func (p *aclPerms) UnmarshalJSON(b []byte) error {
+	var granted bool
+	if err := json.Unmarshal(b, &granted); err == nil {
+		*p = 0
+		if granted {
+			*p = PermAll
+		}
+		return nil
+	}
+	var letters string
+	if err := json.Unmarshal(b, &letters); err == nil {
+		perms, err := parsePerms(letters)
+		*p = aclPerms(perms)
+		return err
+	}
+	var perms int32
+	if err := json.Unmarshal(b, &perms); err != nil {
+		return err
+	}
+	*p = aclPerms(perms & PermAll)
+	return nil
+}
+
+// UnmarshalYAML accepts the same forms as UnmarshalJSON.
+func (p *aclPerms) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var granted bool
+	if err := unmarshal(&granted); err == nil {
+		*p = 0
+		if granted {
+			*p = PermAll
+		}
+		return nil
+	}
+	var perms int32
+	if err := unmarshal(&perms); err == nil {
+		*p = aclPerms(perms & PermAll)
+		return nil
+	}
+	var letters string
+	if err := unmarshal(&letters); err != nil {
+		return err
+	}
+	perms, err := parsePerms(letters)
+	*p = aclPerms(perms)
+	return err
+}
+
+var permLetters = []struct {
+	letter byte
+	perm   int32
+}{
+	{'c', PermCreate},
+	{'d', PermDelete},
+	{'r', PermRead},
+	{'w', PermWrite},
+	{'a', PermAdmin},
+}
+
+// parsePerms converts zkCli style permissions such as "cdrwa" to Perm* bits.
+func parsePerms(s string) (int32, error) {
+	var perms int32
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, pl := range permLetters {
+			if s[i] == pl.letter {
+				perms |= pl.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, errors.New("unknown permission " + string(s[i]))
+		}
+	}
+	return perms, nil
+}
+
+func formatPerms(perms int32) string {
+	b := make([]byte, 0, len(permLetters))
+	for _, pl := range permLetters {
+		if perms&pl.perm != 0 {
+			b = append(b, pl.letter)
+		}
+	}
+	return string(b)
+}
+
+// opPerm returns the permission a request needs, following the checks
+// zookeeper itself applies. Requests without a path need none.
+func opPerm(op Op) int32 {
+	switch op {
+	case opCreate:
+		return PermCreate
+	case opDelete:
+		return PermDelete
+	case opSetData:
+		return PermWrite
+	case opSetAcl:
+		return PermAdmin
+	case opGetData, opExists, opGetChildren, opGetChildren2, opGetAcl, opSync, opCheck:
+		return PermRead
+	}
+	return 0
+}
+
+// opPermPath returns the path the permission of op is checked on. Like
+// zookeeper, create and delete are checked on the parent of the node; the
+// proxy's own tree stays protected either way. Deleting a namespace root is
+// checked on the namespace itself, as the root "/" grants nothing.
+func opPermPath(op Op, path string) string {
+	if (op == opCreate || op == opDelete) && path != "" && !isPermPath(path) {
+		parent := parentPath(path)
+		if op == opDelete && parent == "/" {
+			return path
+		}
+		return parent
+	}
+	return path
+}
+
 type AclCache struct {
-	mu sync.RWMutex
-	m  map[string]map[string]bool
-	t  *time.Ticker
+	mu      sync.RWMutex
+	m       map[string]*aclEntry
+	updated time.Time
+	// closed denies the top-level namespaces without an entry, which zk
+	// mode gets from the empty entries it creates for them.
+	closed bool
+}
+
+func (c *AclCache) setClosed(closed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = closed
+}
+
+// setEntry stores the entry of path, a nil entry removes it.
+func (c *AclCache) setEntry(path string, entry *aclEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry == nil {
+		delete(c.m, path)
+	} else {
+		c.m[path] = entry
+	}
+	c.updated = time.Now()
+}
+
+// replaceTree drops the entries of path and everything below it, then
+// stores the entries of m in their place.
+func (c *AclCache) replaceTree(path string, m map[string]*aclEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.m {
+		if path == "/" || p == path || strings.HasPrefix(p, path+"/") {
+			delete(c.m, p)
+		}
+	}
+	for p, entry := range m {
+		c.m[p] = entry
+	}
+	c.updated = time.Now()
+}
+
+func (c *AclCache) age() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.updated.IsZero() {
+		return 0
+	}
+	return time.Since(c.updated)
 }
 
 var (
-	aclCache        = AclCache{t: time.NewTicker(1 * time.Second), m: make(map[string]map[string]bool)}
+	aclCache        = AclCache{m: make(map[string]*aclEntry)}
 	zkConn          *zk.Conn
 	permRoot        = "/perm"
+	aclLockRoot     = permRoot + "/.lock"
+	aclHistoryRoot  = permRoot + "/.history"
 	enableIPAcl     = false
 	errNotEnableAcl = errors.New("not enable ip acl")
+	errAclReadOnly  = errors.New("ip acl is managed by file")
 )
 
 func InitAcl(servers []string) {
@@ -32,53 +284,64 @@ func InitAcl(servers []string) {
 	if err != nil {
 		panic(err)
 	}
-	exists, _, _ := zkConn.Exists(permRoot)
-	if !exists {
-		_, err = zkConn.Create(permRoot, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil {
-			exists, _, _ = zkConn.Exists(permRoot)
-			if !exists {
-				panic(err)
+	for _, p := range []string{permRoot, aclLockRoot, aclHistoryRoot} {
+		exists, _, _ := zkConn.Exists(p)
+		if !exists {
+			_, err = zkConn.Create(p, []byte{}, 0, zk.WorldACL(zk.PermAll))
+			if err != nil {
+				exists, _, _ = zkConn.Exists(p)
+				if !exists {
+					panic(err)
+				}
 			}
 		}
 	}
-	go updateAcl()
+	w := newAclWatcher()
+	w.resync()
+	go w.run()
 }
 
-func updateAcl() {
-	for range aclCache.t.C {
-		aclCache.mu.RLock()
-		secondPath, _, err := zkConn.Children("/")
-		if err != nil {
-			glog.Errorf("list second path %v", err)
-			continue
-		}
-		for _, p := range secondPath {
-			p = "/" + p
-			if p == permRoot {
-				continue
-			}
-			pp := permRoot + p
-			exists, _, err := zkConn.Exists(pp)
-			if err != nil {
-				glog.Errorf("exists path %s %v", pp, err)
-				continue
-			}
-			if !exists {
-				_, err = zkConn.Create(pp, []byte("{}"), 0, zk.WorldACL(zk.PermAll))
-				if err != nil {
-					glog.Errorf("create path %s %v", pp, err)
-					continue
-				} else {
-					aclCache.m[p] = make(map[string]bool)
-				}
-			} else {
-				aclMap, _ := getAclData(pp)
-				aclCache.m[p] = aclMap
-			}
-		}
-		aclCache.mu.RUnlock()
+// isAclMetaNode reports whether a child of permRoot holds proxy bookkeeping
+// such as locks rather than an acl entry.
+func isAclMetaNode(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// aclNodePath maps a zk path to the node holding its acl entry.
+func aclNodePath(path string) string {
+	if path == "/" {
+		return permRoot
+	}
+	return permRoot + path
+}
+
+// isValidDenyPath reports whether a deny may be attached to path, which
+// unlike a whitelist may be the root.
+func isValidDenyPath(path string) bool {
+	return path == "/" || isValidAclPath(path)
+}
+
+// isValidAclPath reports whether an acl entry may be attached to path.
+func isValidAclPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || path == "/" || strings.HasSuffix(path, "/") {
+		return false
+	}
+	if strings.Contains(path, "//") || isPermPath(path) {
+		return false
 	}
+	return !isAclMetaNode(strings.Split(path, "/")[1])
+}
+
+func isPermPath(path string) bool {
+	return path == permRoot || strings.HasPrefix(path, permRoot+"/")
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
 }
 
 func createLock(path string) error {
@@ -86,8 +349,12 @@ func createLock(path string) error {
 	return err
 }
 
+func lockPath(path string) string {
+	return aclLockRoot + "/" + url.PathEscape(path)
+}
+
 func getLock(path string) error {
-	lockPath := permRoot + path + "/lock"
+	lp := lockPath(path)
 	var err error
 	timeout := time.NewTimer(1 * time.Second)
 	for {
@@ -95,7 +362,7 @@ func getLock(path string) error {
 		case <-timeout.C:
 			return errors.New("get lock timeout")
 		default:
-			err = createLock(lockPath)
+			err = createLock(lp)
 			if err != nil {
 				time.Sleep(100 * time.Nanosecond)
 			} else {
@@ -106,8 +373,7 @@ func getLock(path string) error {
 }
 
 func unLock(path string) {
-	lockPath := permRoot + path + "/lock"
-	zkConn.Delete(lockPath, 0)
+	zkConn.Delete(lockPath(path), 0)
 }
 
 func checkPath(path string) error {
@@ -121,29 +387,75 @@ func checkPath(path string) error {
 	return nil
 }
 
-func getAclData(path string) (aclMap map[string]bool, err error) {
-	aclData, _, err := zkConn.Get(path)
+// ensureAclNode creates pp and any missing parents. Parents are created
+// without data, which means they carry no acl entry of their own.
+func ensureAclNode(pp string) error {
+	if pp == permRoot {
+		return nil
+	}
+	p := permRoot
+	for _, name := range strings.Split(strings.TrimPrefix(pp, permRoot+"/"), "/") {
+		p = p + "/" + name
+		_, err := zkConn.Create(p, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeAclEntry parses the data of an acl node. Empty data means the node
+// only exists to hold nested entries. Entries written before nesting was
+// supported are plain {"ip": true} maps and never inherit.
+func decodeAclEntry(aclData []byte) (*aclEntry, error) {
+	if len(aclData) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(aclData, &fields); err != nil {
+		return nil, err
+	}
+	entry := &aclEntry{}
+	if _, ok := fields["ips"]; ok {
+		if err := json.Unmarshal(aclData, entry); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(aclData, &entry.Ips); err != nil {
+		return nil, err
+	}
+	if entry.Ips == nil {
+		entry.Ips = make(map[string]aclPerms)
+	}
+	return entry, nil
+}
+
+// getAclData returns the entry stored in the acl node path and the version
+// of the node.
+func getAclData(path string) (entry *aclEntry, version int32, err error) {
+	aclData, stat, err := zkConn.Get(path)
 	if err != nil {
 		glog.Errorf("get acl for path %s %v", path, err)
 		return
 	}
-	err = json.Unmarshal(aclData, &aclMap)
+	version = stat.Version
+	entry, err = decodeAclEntry(aclData)
 	if err != nil {
 		glog.Errorf("load acl for path %s %v", path, err)
 	}
 	return
 }
 
-func saveAclData(path string, aclMap map[string]bool) error {
-	aclData, _ := json.Marshal(aclMap)
-	_, err := zkConn.Set(path, aclData, -1)
-	return err
-}
-
-func AddIpAcl(path string, ipaddrs []string) error {
+// updateAclEntry applies fn to the entry of path under the path lock. The
+// entry and its history record are written in one transaction, which fails
+// if the node changed since it was read. A missing entry is created as
+// inheriting from its parent.
+func updateAclEntry(path, caller, action string, fn func(entry *aclEntry)) error {
 	if !enableIPAcl {
 		return errNotEnableAcl
 	}
+	if aclFile != "" {
+		return errAclReadOnly
+	}
 	err := checkPath(path)
 	if err != nil {
 		return err
@@ -152,71 +464,189 @@ func AddIpAcl(path string, ipaddrs []string) error {
 	if err != nil {
 		return err
 	}
-	pp := permRoot + path
-	aclMap, _ := getAclData(pp)
-	for _, ipaddr := range ipaddrs {
-		aclMap[ipaddr] = true
-	}
-	err = saveAclData(pp, aclMap)
-	unLock(path)
-	return err
-}
-
-func DelIpAcl(path string, ipaddrs []string) error {
-	if !enableIPAcl {
-		return errNotEnableAcl
+	defer unLock(path)
+	pp := aclNodePath(path)
+	if err = ensureAclNode(pp); err != nil {
+		return err
 	}
-	err := checkPath(path)
+	entry, version, err := getAclData(pp)
 	if err != nil {
 		return err
 	}
-	err = getLock(path)
+	before := entry.clone()
+	if entry == nil {
+		entry = &aclEntry{Inherit: true, Ips: make(map[string]aclPerms)}
+	}
+	fn(entry)
+	entry.prune(time.Now().Unix())
+	history, err := aclHistoryOp(&AclHistory{
+		Time:   time.Now(),
+		Caller: caller,
+		Action: action,
+		Path:   path,
+		Before: before,
+		After:  entry,
+	})
 	if err != nil {
 		return err
 	}
-	pp := permRoot + path
-	aclMap, _ := getAclData(pp)
-	for _, ipaddr := range ipaddrs {
-		delete(aclMap, ipaddr)
-	}
-	err = saveAclData(pp, aclMap)
-	unLock(path)
+	aclData, _ := json.Marshal(entry)
+	_, err = zkConn.Multi(&zk.SetDataRequest{Path: pp, Data: aclData, Version: version}, history)
 	return err
 }
 
-func ListIpAcl(path string) (ipList []string, err error) {
+// AddIpAcl grants perms on path to ipaddrs, replacing what they had before.
+// The grants expire after ttl unless it is 0.
+func AddIpAcl(path string, ipaddrs []string, perms int32, ttl time.Duration, caller string) error {
+	expire := expireAt(ttl)
+	return updateAclEntry(path, caller, "add", func(entry *aclEntry) {
+		if entry.Expires == nil {
+			entry.Expires = make(map[string]int64)
+		}
+		for _, ipaddr := range ipaddrs {
+			entry.Ips[ipaddr] = aclPerms(perms)
+			if expire > 0 {
+				entry.Expires[ipaddr] = expire
+			} else {
+				delete(entry.Expires, ipaddr)
+			}
+		}
+	})
+}
+
+func DelIpAcl(path string, ipaddrs []string, caller string) error {
+	return updateAclEntry(path, caller, "del", func(entry *aclEntry) {
+		for _, ipaddr := range ipaddrs {
+			delete(entry.Ips, ipaddr)
+			delete(entry.Expires, ipaddr)
+		}
+	})
+}
+
+// AddIpDeny refuses ipaddrs on path and below it for ttl, or for good if
+// ttl is 0.
+func AddIpDeny(path string, ipaddrs []string, ttl time.Duration, caller string) error {
+	expire := expireAt(ttl)
+	return updateAclEntry(path, caller, "deny", func(entry *aclEntry) {
+		if entry.Deny == nil {
+			entry.Deny = make(map[string]int64)
+		}
+		for _, ipaddr := range ipaddrs {
+			entry.Deny[ipaddr] = expire
+		}
+	})
+}
+
+func DelIpDeny(path string, ipaddrs []string, caller string) error {
+	return updateAclEntry(path, caller, "undeny", func(entry *aclEntry) {
+		for _, ipaddr := range ipaddrs {
+			delete(entry.Deny, ipaddr)
+		}
+	})
+}
+
+// SetIpAclInherit switches the entry of path between extending and
+// overriding the whitelist of its ancestors.
+func SetIpAclInherit(path string, inherit bool, caller string) error {
+	return updateAclEntry(path, caller, "inherit", func(entry *aclEntry) {
+		entry.Inherit = inherit
+	})
+}
+
+// ListIpAcl returns a copy of the entry of path without expired grants.
+func ListIpAcl(path string) (*aclEntry, error) {
 	if !enableIPAcl {
-		err = errNotEnableAcl
-		return
+		return nil, errNotEnableAcl
 	}
-	aclMap, ok := aclCache.m[path]
+	aclCache.mu.RLock()
+	entry, ok := aclCache.m[path]
+	aclCache.mu.RUnlock()
 	if !ok {
-		err = errors.New(path + " is not exists")
-		return
+		return nil, errors.New(path + " is not exists")
 	}
-	for ip := range aclMap {
-		ipList = append(ipList, ip)
-	}
-	return
+	entry = entry.clone()
+	entry.prune(time.Now().Unix())
+	return entry, nil
+}
+
+// The rules an acl decision can be made by.
+const (
+	aclRuleDisabled = "acl_disabled"
+	aclRuleNoPath   = "no_path"
+	aclRulePermRoot = "perm_protected"
+	aclRuleDeny     = "deny"
+	aclRuleGrant    = "grant"
+	aclRuleOverride = "override"
+	aclRuleNoGrant  = "no_grant"
+	aclRuleUnknown  = "unknown_path"
+)
+
+// AclDecision tells whether a request is allowed and which rule decided it.
+// Path is the entry the rule was found in, if any.
+type AclDecision struct {
+	Allowed bool      `json:"allowed"`
+	Rule    string    `json:"rule"`
+	Path    string    `json:"path,omitempty"`
+	Entry   *aclEntry `json:"entry,omitempty"`
 }
 
-func CheckIpAcl(path string, ipaddr string) bool {
+// CheckIpAcl reports whether ipaddr holds perm on path.
+func CheckIpAcl(path string, ipaddr string, perm int32) bool {
+	return evalIpAcl(path, ipaddr, perm).Allowed
+}
+
+// evalIpAcl decides whether ipaddr holds perm on path. The entry of the
+// decision is shared with the cache and must not be modified.
+func evalIpAcl(path string, ipaddr string, perm int32) AclDecision {
 	if !enableIPAcl {
-		return true
+		return AclDecision{Allowed: true, Rule: aclRuleDisabled}
 	}
-	if path == "/" || path == "" {
-		return true
+	if path == "" || perm == 0 {
+		return AclDecision{Allowed: true, Rule: aclRuleNoPath}
 	}
-	secondPath := strings.Join(strings.Split(path, "/")[:2], "/")
-	if secondPath == permRoot {
-		return false
+	if isPermPath(path) {
+		return AclDecision{Allowed: false, Rule: aclRulePermRoot}
 	}
-	aclMap, ok := aclCache.m[secondPath]
-	if !ok {
-		return true
-	} else {
-		_, ok = aclMap[ipaddr]
-		return ok
+	now := time.Now().Unix()
+	aclCache.mu.RLock()
+	defer aclCache.mu.RUnlock()
+	// a deny anywhere above the path wins over every whitelist
+	for p := path; ; p = parentPath(p) {
+		if entry, ok := aclCache.m[p]; ok && entry.denies(ipaddr, now) {
+			return AclDecision{Allowed: false, Rule: aclRuleDeny, Path: p, Entry: entry}
+		}
+		if p == "/" {
+			break
+		}
 	}
-	return false
+	// walk up to the longest prefix with an entry, then follow inheritance
+	var last AclDecision
+	for p := path; p != "/"; p = parentPath(p) {
+		entry, ok := aclCache.m[p]
+		if !ok {
+			continue
+		}
+		if entry.grants(ipaddr, perm, now) {
+			return AclDecision{Allowed: true, Rule: aclRuleGrant, Path: p, Entry: entry}
+		}
+		if !entry.Inherit {
+			return AclDecision{Allowed: false, Rule: aclRuleOverride, Path: p, Entry: entry}
+		}
+		last = AclDecision{Allowed: false, Rule: aclRuleNoGrant, Path: p, Entry: entry}
+	}
+	if last.Rule == "" {
+		if aclCache.closed && path != "/" {
+			ns := learnPath(path, 1)
+			return AclDecision{Allowed: false, Rule: aclRuleOverride, Path: ns, Entry: &aclEntry{Ips: map[string]aclPerms{}}}
+		}
+		return AclDecision{Allowed: true, Rule: aclRuleUnknown}
+	}
+	return last
+}
+
+// SimulateIpAcl evaluates a request the way the proxy would serve it.
+func SimulateIpAcl(path string, ipaddr string, op Op) AclDecision {
+	d := evalIpAcl(opPermPath(op, path), ipaddr, opPerm(op))
+	d.Entry = d.Entry.clone()
+	return d
 }
@@ -0,0 +1,96 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+// withAclCache serves the acl checks of a test from entries.
+func withAclCache(t *testing.T, entries map[string]*aclEntry) {
+	saved, savedEnabled := aclCache.m, enableIPAcl
+	aclCache.m, enableIPAcl = entries, true
+	t.Cleanup(func() {
+		aclCache.m, enableIPAcl = saved, savedEnabled
+	})
+}
+
+func TestEvalIpAcl(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Unix()
+	withAclCache(t, map[string]*aclEntry{
+		"/":   {Deny: map[string]int64{"10.0.0.9": 0}},
+		"/ns": {Ips: map[string]aclPerms{"10.0.0.1": PermAll, "10.0.0.2": aclPerms(PermRead)}},
+		"/ns/inherit": {
+			Inherit: true,
+			Ips:     map[string]aclPerms{"10.0.0.3": PermAll, "10.0.0.4": PermAll},
+			Expires: map[string]int64{"10.0.0.4": past},
+		},
+		"/ns/override": {Ips: map[string]aclPerms{"10.0.0.3": PermAll}},
+		"/ns/denied":   {Inherit: true, Ips: map[string]aclPerms{"10.0.0.5": PermAll}, Deny: map[string]int64{"10.0.0.1": 0, "10.0.0.2": past}},
+	})
+	tests := []struct {
+		path    string
+		ip      string
+		perm    int32
+		allowed bool
+		rule    string
+	}{
+		{"/ns/a", "10.0.0.1", PermWrite, true, aclRuleGrant},
+		{"/ns/a", "10.0.0.2", PermRead, true, aclRuleGrant},
+		{"/ns/a", "10.0.0.2", PermWrite, false, aclRuleOverride},
+		{"/ns/a", "10.0.0.3", PermRead, false, aclRuleOverride},
+		{"/ns/inherit/a", "10.0.0.1", PermWrite, true, aclRuleGrant},
+		{"/ns/inherit/a", "10.0.0.3", PermWrite, true, aclRuleGrant},
+		{"/ns/inherit/a", "10.0.0.4", PermRead, false, aclRuleOverride},
+		{"/ns/override/a", "10.0.0.1", PermRead, false, aclRuleOverride},
+		{"/ns/override/a", "10.0.0.3", PermRead, true, aclRuleGrant},
+		{"/ns/denied/a", "10.0.0.1", PermRead, false, aclRuleDeny},
+		{"/ns/denied/a", "10.0.0.2", PermRead, true, aclRuleGrant},
+		{"/ns/denied/a", "10.0.0.3", PermRead, false, aclRuleOverride},
+		{"/ns/inherit/x/y", "10.0.0.5", PermRead, false, aclRuleOverride},
+		{"/ns/a", "10.0.0.9", PermRead, false, aclRuleDeny},
+		{"/other", "10.0.0.3", PermWrite, true, aclRuleUnknown},
+		{"/perm/ns", "10.0.0.1", PermRead, false, aclRulePermRoot},
+		{"", "10.0.0.3", PermRead, true, aclRuleNoPath},
+		{"/ns/a", "10.0.0.3", 0, true, aclRuleNoPath},
+	}
+	for _, tt := range tests {
+		d := evalIpAcl(tt.path, tt.ip, tt.perm)
+		if d.Allowed != tt.allowed || d.Rule != tt.rule {
+			t.Errorf("evalIpAcl(%q, %s, %d) = %v %s, want %v %s",
+				tt.path, tt.ip, tt.perm, d.Allowed, d.Rule, tt.allowed, tt.rule)
+		}
+	}
+}
+
+func TestSimulateIpAclParent(t *testing.T) {
+	withAclCache(t, map[string]*aclEntry{
+		"/ns":      {Ips: map[string]aclPerms{"10.0.0.1": aclPerms(PermCreate | PermDelete)}},
+		"/ns/leaf": {Ips: map[string]aclPerms{"10.0.0.2": PermAll}},
+	})
+	tests := []struct {
+		path    string
+		ip      string
+		op      Op
+		allowed bool
+	}{
+		// create and delete need the permission on the parent
+		{"/ns/leaf", "10.0.0.1", opCreate, true},
+		{"/ns/leaf", "10.0.0.1", opDelete, true},
+		{"/ns/leaf", "10.0.0.2", opCreate, false},
+		{"/ns/leaf", "10.0.0.2", opDelete, false},
+		{"/ns/leaf", "10.0.0.1", opSetData, false},
+		{"/ns/leaf", "10.0.0.2", opSetData, true},
+		// a namespace root is deleted with the permission on itself
+		{"/ns", "10.0.0.2", opDelete, false},
+		{"/ns", "10.0.0.1", opDelete, true},
+		{"/perm", "10.0.0.1", opDelete, false},
+		{"/perm/ns", "10.0.0.1", opCreate, false},
+	}
+	for _, tt := range tests {
+		d := SimulateIpAcl(tt.path, tt.ip, tt.op)
+		if d.Allowed != tt.allowed {
+			t.Errorf("SimulateIpAcl(%q, %s, %s) = %v (%s), want %v",
+				tt.path, tt.ip, opName(tt.op), d.Allowed, d.Rule, tt.allowed)
+		}
+	}
+}
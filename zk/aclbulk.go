@@ -0,0 +1,232 @@
+package zk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// AclChange is one difference between the acl set and an imported document.
+type AclChange struct {
+	Path   string    `json:"path"`
+	Action string    `json:"action"`
+	Before *aclEntry `json:"before"`
+	After  *aclEntry `json:"after"`
+}
+
+// decodeAclDocument parses and validates a whole acl set, which maps zk paths
+// to entries. Nothing is returned unless every entry is valid.
+func decodeAclDocument(data []byte) (map[string]*aclEntry, error) {
+	m := make(map[string]*aclEntry)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if err := validateAclDocument(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validateAclDocument checks every entry of a decoded acl set and fills in
+// the whitelists left out.
+func validateAclDocument(m map[string]*aclEntry) error {
+	for p, entry := range m {
+		if !isValidDenyPath(p) {
+			return errors.New("invalid path " + p)
+		}
+		if entry == nil {
+			return errors.New("empty entry for " + p)
+		}
+		if entry.Ips == nil {
+			entry.Ips = make(map[string]aclPerms)
+		}
+		for ip := range entry.Ips {
+			if net.ParseIP(ip) == nil {
+				return errors.New("invalid ip " + ip + " for " + p)
+			}
+		}
+		for ip := range entry.Deny {
+			if net.ParseIP(ip) == nil {
+				return errors.New("invalid ip " + ip + " for " + p)
+			}
+		}
+	}
+	return nil
+}
+
+// ExportIpAcl returns a copy of the whole acl set.
+func ExportIpAcl() (map[string]*aclEntry, error) {
+	if !enableIPAcl {
+		return nil, errNotEnableAcl
+	}
+	now := time.Now().Unix()
+	aclCache.mu.RLock()
+	defer aclCache.mu.RUnlock()
+	m := make(map[string]*aclEntry, len(aclCache.m))
+	for p, entry := range aclCache.m {
+		m[p] = entry.clone()
+		m[p].prune(now)
+	}
+	return m, nil
+}
+
+func sameAclEntry(a, b *aclEntry) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+// diffIpAcl lists what importing m would change. Entries missing from m are
+// only removed if replace is set. A namespace root without an entry is open
+// to every ip, so its entry is emptied instead, which denies all.
+func diffIpAcl(current, m map[string]*aclEntry, replace bool) []AclChange {
+	changes := []AclChange{}
+	for p, entry := range m {
+		before, ok := current[p]
+		if !ok {
+			changes = append(changes, AclChange{Path: p, Action: "add", After: entry})
+		} else if !sameAclEntry(before, entry) {
+			changes = append(changes, AclChange{Path: p, Action: "change", Before: before, After: entry})
+		}
+	}
+	if replace {
+		for p, before := range current {
+			if _, ok := m[p]; ok {
+				continue
+			}
+			if p != "/" && parentPath(p) == "/" {
+				empty := &aclEntry{Ips: make(map[string]aclPerms)}
+				if !sameAclEntry(before, empty) {
+					changes = append(changes, AclChange{Path: p, Action: "change", Before: before, After: empty})
+				}
+				continue
+			}
+			changes = append(changes, AclChange{Path: p, Action: "remove", Before: before})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// unwrapAclDocument returns the acl set of data, which is either a bare map
+// or the response of the export endpoint. Paths start with "/", so a bare
+// map never has the fields of the response.
+func unwrapAclDocument(data []byte) []byte {
+	var resp struct {
+		Code *int            `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &resp); err == nil && resp.Code != nil && len(resp.Data) > 0 {
+		return resp.Data
+	}
+	return data
+}
+
+// ImportIpAcl validates the acl document data, either a bare map or the
+// output of the export endpoint, and applies it in a single zk transaction
+// together with the history of every entry. Each node is read back first and
+// written at the version read, so the import fails instead of overwriting a
+// change made since the diff. With dryRun nothing is written and only the
+// diff is returned.
+func ImportIpAcl(data []byte, replace, dryRun bool, caller string) ([]AclChange, error) {
+	if !enableIPAcl {
+		return nil, errNotEnableAcl
+	}
+	m, err := decodeAclDocument(unwrapAclDocument(data))
+	if err != nil {
+		return nil, err
+	}
+	current, _ := ExportIpAcl()
+	changes := diffIpAcl(current, m, replace)
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+	if aclFile != "" {
+		return nil, errAclReadOnly
+	}
+
+	ops := []interface{}{}
+	planned := make(map[string]bool)
+	now := time.Now().Unix()
+	for _, c := range changes {
+		if c.After != nil {
+			if err = checkPath(c.Path); err != nil {
+				return nil, err
+			}
+		}
+		pp := aclNodePath(c.Path)
+		var aclData []byte
+		if c.After != nil {
+			aclData, _ = json.Marshal(c.After)
+		}
+		if planned[pp] {
+			// created without data earlier in this transaction
+			ops = append(ops, &zk.SetDataRequest{Path: pp, Data: aclData, Version: 0})
+			continue
+		}
+		stored, stat, err := zkConn.Get(pp)
+		if err != nil && err != zk.ErrNoNode {
+			return nil, err
+		}
+		if err == nil {
+			before, err := decodeAclEntry(stored)
+			if err != nil {
+				return nil, err
+			}
+			if before != nil {
+				before.prune(now)
+			}
+			if !sameAclEntry(before, c.Before) {
+				return nil, errors.New("acl of " + c.Path + " changed during import")
+			}
+			if c.After != nil || len(stored) > 0 {
+				ops = append(ops, &zk.SetDataRequest{Path: pp, Data: aclData, Version: stat.Version})
+			}
+			continue
+		}
+		if c.After == nil {
+			continue
+		}
+		// create the missing parents without entries, then the node itself
+		var missing []string
+		for p := parentPath(pp); p != permRoot && !planned[p]; p = parentPath(p) {
+			exists, _, err := zkConn.Exists(p)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				break
+			}
+			missing = append(missing, p)
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			ops = append(ops, &zk.CreateRequest{Path: missing[i], Data: []byte{}, Acl: zk.WorldACL(zk.PermAll)})
+			planned[missing[i]] = true
+		}
+		ops = append(ops, &zk.CreateRequest{Path: pp, Data: aclData, Acl: zk.WorldACL(zk.PermAll)})
+		planned[pp] = true
+	}
+	for _, c := range changes {
+		history, err := aclHistoryOp(&AclHistory{
+			Time:   time.Now(),
+			Caller: caller,
+			Action: "import",
+			Path:   c.Path,
+			Before: c.Before,
+			After:  c.After,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, history)
+	}
+	if _, err = zkConn.Multi(ops...); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
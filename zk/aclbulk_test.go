@@ -0,0 +1,98 @@
+package zk
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAclExportImportRoundTrip(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	withAclCache(t, map[string]*aclEntry{
+		"/":   {Ips: map[string]aclPerms{}, Deny: map[string]int64{"10.0.0.9": 0}},
+		"/ns": {Ips: map[string]aclPerms{"10.0.0.1": PermAll, "10.0.0.2": aclPerms(PermRead)}},
+		"/ns/svc": {
+			Inherit: true,
+			Ips:     map[string]aclPerms{"10.0.0.3": aclPerms(PermRead | PermWrite)},
+			Expires: map[string]int64{"10.0.0.3": future},
+		},
+	})
+	w := httptest.NewRecorder()
+	ExportIpAclSet(w, httptest.NewRequest("GET", "/ipacl/export", nil))
+	exported := w.Body.Bytes()
+
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(exported, &resp); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"response", exported},
+		{"bare map", resp.Data},
+	}
+	for _, tt := range tests {
+		changes, err := ImportIpAcl(tt.data, true, true, "test")
+		if err != nil {
+			t.Errorf("import %s: %v", tt.name, err)
+			continue
+		}
+		if len(changes) != 0 {
+			t.Errorf("import %s changes %+v, want none", tt.name, changes)
+		}
+	}
+
+	changes, err := ImportIpAcl([]byte(`{"code": 0, "data": {"/ns": {"ips": {"10.0.0.1": "r"}}}}`), true, true, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/": "remove", "/ns": "change", "/ns/svc": "remove"}
+	if len(changes) != len(want) {
+		t.Fatalf("changes %+v, want %v", changes, want)
+	}
+	for _, c := range changes {
+		if want[c.Path] != c.Action {
+			t.Errorf("change of %s is %s, want %s", c.Path, c.Action, want[c.Path])
+		}
+	}
+}
+
+func TestAclImportReplaceKeepsNamespacesClosed(t *testing.T) {
+	withAclCache(t, map[string]*aclEntry{
+		"/ns":     {Ips: map[string]aclPerms{"10.0.0.1": PermAll}},
+		"/ns/svc": {Inherit: true, Ips: map[string]aclPerms{"10.0.0.2": PermAll}},
+		"/other":  {Ips: map[string]aclPerms{"10.0.0.1": PermAll}},
+	})
+	changes, err := ImportIpAcl([]byte(`{"/other": {"ips": {"10.0.0.1": "cdrwa"}}}`), true, true, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/ns": "change", "/ns/svc": "remove"}
+	if len(changes) != len(want) {
+		t.Fatalf("changes %+v, want %v", changes, want)
+	}
+	imported := make(map[string]*aclEntry)
+	for p, entry := range aclCache.m {
+		imported[p] = entry
+	}
+	for _, c := range changes {
+		if want[c.Path] != c.Action {
+			t.Errorf("change of %s is %s, want %s", c.Path, c.Action, want[c.Path])
+		}
+		if c.After == nil {
+			delete(imported, c.Path)
+		} else {
+			imported[c.Path] = c.After
+		}
+	}
+	aclCache.m = imported
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if d := evalIpAcl("/ns/svc", ip, PermRead); d.Allowed {
+			t.Errorf("%s allowed on /ns/svc after the import by %s", ip, d.Rule)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package zk
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AclDenial counts the requests one client was refused on one path.
+type AclDenial struct {
+	Path  string    `json:"path"`
+	Ip    string    `json:"ip"`
+	Op    string    `json:"op"`
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+type aclDenialKey struct {
+	path string
+	ip   string
+	op   Op
+}
+
+var (
+	aclShadow        = false
+	aclDenialLimit   = 10000
+	aclDenialsMu     sync.Mutex
+	aclDenials       = make(map[aclDenialKey]*AclDenial)
+	aclDenialCount   = expvar.NewInt("acl_denials")
+	aclDenialDropped = expvar.NewInt("acl_denials_dropped")
+)
+
+// SetAclShadow makes the ip acl log and count denials while still forwarding
+// the denied requests, so whitelists can be checked before enforcing them.
+func SetAclShadow() {
+	aclShadow = true
+	glog.V(1).Infof("set ip acl shadow mode")
+}
+
+func recordAclDenial(path, ipaddr string, op Op) {
+	aclDenialCount.Add(1)
+	key := aclDenialKey{path, ipaddr, op}
+	aclDenialsMu.Lock()
+	defer aclDenialsMu.Unlock()
+	d, ok := aclDenials[key]
+	if !ok {
+		if len(aclDenials) >= aclDenialLimit {
+			aclDenialDropped.Add(1)
+			return
+		}
+		d = &AclDenial{Path: path, Ip: ipaddr, Op: opName(op)}
+		aclDenials[key] = d
+	}
+	d.Count++
+	d.Last = time.Now()
+}
+
+// ListAclDenials returns the recorded denials, most frequent first.
+func ListAclDenials() []AclDenial {
+	aclDenialsMu.Lock()
+	denials := make([]AclDenial, 0, len(aclDenials))
+	for _, d := range aclDenials {
+		denials = append(denials, *d)
+	}
+	aclDenialsMu.Unlock()
+	sort.Slice(denials, func(i, j int) bool {
+		if denials[i].Count != denials[j].Count {
+			return denials[i].Count > denials[j].Count
+		}
+		return denials[i].Path < denials[j].Path
+	})
+	return denials
+}
+
+func ResetAclDenials() {
+	aclDenialsMu.Lock()
+	aclDenials = make(map[aclDenialKey]*AclDenial)
+	aclDenialsMu.Unlock()
+}
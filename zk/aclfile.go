@@ -0,0 +1,113 @@
+package zk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// The acl file maps zk paths to entries, for example
+//
+//	{
+//	    "/dubbo": {"inherit": false, "ips": {"10.0.0.1": "cdrwa"}},
+//	    "/dubbo/com.foo.Service": {"inherit": true, "ips": {"10.0.0.2": "r"}},
+//	    "/": {"deny": {"10.0.0.9": 0}}
+//	}
+//
+// or the same in yaml when the file name ends with .yaml or .yml:
+//
+//	/dubbo:
+//	  ips: {10.0.0.1: cdrwa}
+//	/dubbo/com.foo.Service:
+//	  inherit: true
+//	  ips: {10.0.0.2: r}
+//
+// It replaces the entries under permRoot, so the proxy never writes to zk.
+// As in zk, where every top-level node gets an empty entry, a namespace
+// missing from the file is closed to everyone.
+var (
+	aclFile              string
+	aclFileMu            sync.Mutex
+	aclFileInfo          os.FileInfo
+	aclFileCheckInterval = 1 * time.Second
+)
+
+// InitFileAcl enables the ip acl with entries loaded from path, which is
+// reloaded whenever it changes.
+func InitFileAcl(path string) {
+	enableIPAcl = true
+	aclFile = path
+	if err := ReloadAclFile(); err != nil {
+		panic(err)
+	}
+	go watchAclFile()
+}
+
+// ReloadAclFile validates the acl file and swaps it into the cache. The cache
+// is left untouched if the file is invalid.
+func ReloadAclFile() error {
+	aclFileMu.Lock()
+	defer aclFileMu.Unlock()
+	fi, err := os.Stat(aclFile)
+	if err != nil {
+		aclRefreshErrors.Add(1)
+		return err
+	}
+	// remember the attempt, a broken file is retried once it changes again
+	aclFileInfo = fi
+	m, err := loadAclFile(aclFile)
+	if err != nil {
+		glog.Errorf("load acl file %s %v", aclFile, err)
+		aclRefreshErrors.Add(1)
+		return err
+	}
+	aclCache.replaceTree("/", m)
+	aclCache.setClosed(true)
+	glog.V(1).Infof("load acl file %s with %d entries", aclFile, len(m))
+	return nil
+}
+
+func loadAclFile(path string) (map[string]*aclEntry, error) {
+	aclData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" {
+		return decodeAclDocument(aclData)
+	}
+	m := make(map[string]*aclEntry)
+	if err := yaml.UnmarshalStrict(aclData, &m); err != nil {
+		return nil, err
+	}
+	if err := validateAclDocument(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func aclFileChanged() bool {
+	aclFileMu.Lock()
+	defer aclFileMu.Unlock()
+	fi, err := os.Stat(aclFile)
+	if err != nil {
+		return false
+	}
+	return aclFileInfo == nil || !fi.ModTime().Equal(aclFileInfo.ModTime()) || fi.Size() != aclFileInfo.Size()
+}
+
+func watchAclFile() {
+	t := time.NewTicker(aclFileCheckInterval)
+	defer t.Stop()
+	for range t.C {
+		if aclFileChanged() {
+			ReloadAclFile()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package zk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAclFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aclfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"acl.json": `{
+			"/dubbo": {"ips": {"10.0.0.1": "cdrwa", "10.0.0.3": true}},
+			"/dubbo/svc": {"inherit": true, "ips": {"10.0.0.2": 1}},
+			"/": {"deny": {"10.0.0.9": 0}}
+		}`,
+		"acl.yaml": `
+/dubbo:
+  ips: {10.0.0.1: cdrwa, 10.0.0.3: true}
+/dubbo/svc:
+  inherit: true
+  ips:
+    10.0.0.2: 1
+/:
+  deny: {10.0.0.9: 0}
+`,
+	}
+	want := map[string]*aclEntry{
+		"/dubbo":     {Ips: map[string]aclPerms{"10.0.0.1": PermAll, "10.0.0.3": PermAll}},
+		"/dubbo/svc": {Inherit: true, Ips: map[string]aclPerms{"10.0.0.2": aclPerms(PermRead)}},
+		"/":          {Ips: map[string]aclPerms{}, Deny: map[string]int64{"10.0.0.9": 0}},
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := loadAclFile(path)
+		if err != nil {
+			t.Errorf("load %s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("load %s = %v, want %v", name, m, want)
+		}
+	}
+
+	bad := map[string]string{
+		"ip.yaml":    "/dubbo:\n  ips: {nohost: r}\n",
+		"field.yaml": "/dubbo:\n  allow: {10.0.0.1: r}\n",
+		"perms.yml":  "/dubbo:\n  ips: {10.0.0.1: rx}\n",
+		"path.json":  `{"dubbo": {"ips": {}}}`,
+	}
+	for name, data := range bad {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAclFile(path); err == nil {
+			t.Errorf("load %s succeeded, want an error", name)
+		}
+	}
+}
+
+func TestFileAclClosesNamespaces(t *testing.T) {
+	withAclCache(t, map[string]*aclEntry{
+		"/dubbo": {Ips: map[string]aclPerms{"10.0.0.1": PermAll}},
+	})
+	aclCache.setClosed(true)
+	defer aclCache.setClosed(false)
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/dubbo/svc", true},
+		{"/other", false},
+		{"/other/svc", false},
+		{"/", true},
+	}
+	for _, tt := range tests {
+		if got := CheckIpAcl(tt.path, "10.0.0.1", PermRead); got != tt.allowed {
+			t.Errorf("CheckIpAcl(%q) = %v, want %v", tt.path, got, tt.allowed)
+		}
+	}
+}
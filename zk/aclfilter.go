@@ -0,0 +1,107 @@
+package zk
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// aclFilterPaths are the paths whose children are filtered by the ip acl,
+// so clients only see the namespaces they may read.
+var aclFilterPaths = map[string]bool{"/": true}
+
+func SetAclFilterPaths(paths []string) {
+	aclFilterPaths = make(map[string]bool)
+	for _, path := range paths {
+		if len(path) > 0 {
+			aclFilterPaths[path] = true
+		}
+	}
+	glog.V(1).Infof("set acl filter paths %v", paths)
+}
+
+type childrenFilter struct {
+	op   Op
+	path string
+}
+
+func shouldFilterChildren(op Op, path string) bool {
+	if !enableIPAcl || aclShadow {
+		return false
+	}
+	return (op == opGetChildren || op == opGetChildren2) && aclFilterPaths[path]
+}
+
+// trackChildren remembers a children request whose response must be
+// filtered. It has to be called before the request is forwarded.
+func (s *session) trackChildren(xid Xid, op Op, path string) {
+	s.filterMu.Lock()
+	s.filters[xid] = childrenFilter{op, path}
+	s.filterMu.Unlock()
+}
+
+// filterResponse drops the children the client may not read from a tracked
+// response. Any other response is returned unchanged.
+func (s *session) filterResponse(hdr *ResponseHeader, raw []byte) []byte {
+	if hdr == nil {
+		return raw
+	}
+	s.filterMu.Lock()
+	f, ok := s.filters[hdr.Xid]
+	if ok {
+		delete(s.filters, hdr.Xid)
+	}
+	s.filterMu.Unlock()
+	if !ok || hdr.Err != errOk {
+		return raw
+	}
+
+	clientAddr := strings.Split(s.clientAddress, ":")[0]
+	var resp interface{}
+	n, err := decodePacket(raw, &ResponseHeader{})
+	if err == nil {
+		switch f.op {
+		case opGetChildren:
+			r := &GetChildrenResponse{}
+			if _, err = decodePacket(raw[n:], r); err == nil {
+				r.Children = filterChildren(f.path, clientAddr, r.Children)
+			}
+			resp = r
+		case opGetChildren2:
+			r := &GetChildren2Response{}
+			if _, err = decodePacket(raw[n:], r); err == nil {
+				r.Children = filterChildren(f.path, clientAddr, r.Children)
+				r.Stat.NumChildren = int32(len(r.Children))
+			}
+			resp = r
+		}
+	}
+	if err != nil {
+		glog.Errorf("decode children of %s for %d %v", f.path, int(hdr.Xid), err)
+		return raw
+	}
+	buf := make([]byte, len(raw))
+	hn, err := encodePacket(buf, hdr)
+	if err == nil {
+		n, err = encodePacket(buf[hn:], resp)
+	}
+	if err != nil {
+		glog.Errorf("encode children of %s for %d %v", f.path, int(hdr.Xid), err)
+		return raw
+	}
+	return buf[:hn+n]
+}
+
+func filterChildren(path, ipaddr string, children []string) []string {
+	prefix := path + "/"
+	if path == "/" {
+		prefix = "/"
+	}
+	allowed := make([]string, 0, len(children))
+	for _, child := range children {
+		if CheckIpAcl(prefix+child, ipaddr, PermRead) {
+			allowed = append(allowed, child)
+		}
+	}
+	return allowed
+}
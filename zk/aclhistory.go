@@ -0,0 +1,116 @@
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// AclHistory records one change of an acl entry. Records are kept as
+// sequential nodes under aclHistoryRoot, the sequence being the version.
+type AclHistory struct {
+	Version int64     `json:"version"`
+	Time    time.Time `json:"time"`
+	Caller  string    `json:"caller"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Before  *aclEntry `json:"before"`
+	After   *aclEntry `json:"after"`
+}
+
+const aclHistoryPrefix = "v-"
+
+func aclHistoryPath(path string) string {
+	return aclHistoryRoot + "/" + url.PathEscape(path)
+}
+
+// aclHistoryOp returns the create of the history record h, to be sent in the
+// transaction which changes the entry.
+func aclHistoryOp(h *AclHistory) (*zk.CreateRequest, error) {
+	hp := aclHistoryPath(h.Path)
+	_, err := zkConn.Create(hp, []byte{}, 0, zk.WorldACL(zk.PermAll))
+	if err != nil && err != zk.ErrNodeExists {
+		return nil, err
+	}
+	data, _ := json.Marshal(h)
+	return &zk.CreateRequest{
+		Path:  hp + "/" + aclHistoryPrefix,
+		Data:  data,
+		Acl:   zk.WorldACL(zk.PermAll),
+		Flags: zk.FlagSequence,
+	}, nil
+}
+
+func getAclHistory(path string, version int64) (*AclHistory, error) {
+	data, _, err := zkConn.Get(fmt.Sprintf("%s/%s%010d", aclHistoryPath(path), aclHistoryPrefix, version))
+	if err == zk.ErrNoNode {
+		return nil, fmt.Errorf("version %d of %s is not exists", version, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := &AclHistory{}
+	if err = json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	h.Version = version
+	return h, nil
+}
+
+// ListAclHistory returns the changes of the entry of path, oldest first.
+func ListAclHistory(path string) ([]*AclHistory, error) {
+	if !enableIPAcl {
+		return nil, errNotEnableAcl
+	}
+	if aclFile != "" {
+		return nil, errAclReadOnly
+	}
+	children, _, err := zkConn.Children(aclHistoryPath(path))
+	if err == zk.ErrNoNode {
+		return []*AclHistory{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	history := make([]*AclHistory, 0, len(children))
+	for _, child := range children {
+		version, err := strconv.ParseInt(strings.TrimPrefix(child, aclHistoryPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		h, err := getAclHistory(path, version)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
+
+// RollbackIpAcl restores the entry of path to what it was right after the
+// change with the given version. The rollback is itself recorded.
+func RollbackIpAcl(path string, version int64, caller string) error {
+	if !enableIPAcl {
+		return errNotEnableAcl
+	}
+	if aclFile != "" {
+		return errAclReadOnly
+	}
+	h, err := getAclHistory(path, version)
+	if err != nil {
+		return err
+	}
+	if h.After == nil {
+		return fmt.Errorf("version %d of %s has no entry", version, path)
+	}
+	return updateAclEntry(path, caller, fmt.Sprintf("rollback:%d", version), func(entry *aclEntry) {
+		*entry = *h.After.clone()
+	})
+}
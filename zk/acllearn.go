@@ -0,0 +1,121 @@
+package zk
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AclProposal is a whitelist proposed by learn mode, with the same args as
+// the /api/v1/whitelist/add api.
+type AclProposal struct {
+	Path   string `json:"path"`
+	Iplist string `json:"iplist"`
+	Perms  string `json:"perms"`
+}
+
+var (
+	aclLearnDepth    = 1
+	aclLearnLimit    = 10000
+	aclLearning      int32
+	aclLearnMu       sync.Mutex
+	aclLearnUntil    time.Time
+	aclLearnSeen     = make(map[string]map[string]int32)
+	errLearnNotStart = errors.New("acl learn mode is not started")
+)
+
+// StartAclLearn records which clients use which paths for window, dropping
+// what was learned before. Paths are cut to depth components.
+func StartAclLearn(window time.Duration, depth int) {
+	aclLearnMu.Lock()
+	aclLearnUntil = time.Now().Add(window)
+	aclLearnDepth = depth
+	aclLearnSeen = make(map[string]map[string]int32)
+	aclLearnMu.Unlock()
+	atomic.StoreInt32(&aclLearning, 1)
+	glog.V(1).Infof("start acl learn for %v with depth %d", window, depth)
+}
+
+func StopAclLearn() {
+	atomic.StoreInt32(&aclLearning, 0)
+	glog.V(1).Infof("stop acl learn")
+}
+
+// learnPath cuts path to the first depth components.
+func learnPath(path string, depth int) string {
+	names := strings.Split(path, "/")
+	if len(names) > depth+1 {
+		names = names[:depth+1]
+	}
+	return strings.Join(names, "/")
+}
+
+func recordAclLearn(path, ipaddr string, op Op) {
+	if atomic.LoadInt32(&aclLearning) == 0 {
+		return
+	}
+	perm := opPerm(op)
+	if perm == 0 || path == "" || path == "/" || isPermPath(path) {
+		return
+	}
+	aclLearnMu.Lock()
+	defer aclLearnMu.Unlock()
+	if time.Now().After(aclLearnUntil) {
+		atomic.StoreInt32(&aclLearning, 0)
+		return
+	}
+	path = learnPath(path, aclLearnDepth)
+	ips, ok := aclLearnSeen[path]
+	if !ok {
+		if len(aclLearnSeen) >= aclLearnLimit {
+			return
+		}
+		ips = make(map[string]int32)
+		aclLearnSeen[path] = ips
+	}
+	ips[ipaddr] |= perm
+}
+
+// ExportAclLearn proposes whitelists from what was learned, one per path
+// and set of permissions.
+func ExportAclLearn() ([]AclProposal, error) {
+	aclLearnMu.Lock()
+	defer aclLearnMu.Unlock()
+	if aclLearnUntil.IsZero() {
+		return nil, errLearnNotStart
+	}
+	proposals := []AclProposal{}
+	for path, ips := range aclLearnSeen {
+		byPerms := make(map[int32][]string)
+		for ip, perms := range ips {
+			byPerms[perms] = append(byPerms[perms], ip)
+		}
+		for perms, ipList := range byPerms {
+			sort.Strings(ipList)
+			proposals = append(proposals, AclProposal{
+				Path:   path,
+				Iplist: strings.Join(ipList, ","),
+				Perms:  formatPerms(perms),
+			})
+		}
+	}
+	sort.Slice(proposals, func(i, j int) bool {
+		if proposals[i].Path != proposals[j].Path {
+			return proposals[i].Path < proposals[j].Path
+		}
+		return proposals[i].Perms < proposals[j].Perms
+	})
+	return proposals, nil
+}
+
+// AclLearnState tells whether learn mode is running and until when.
+func AclLearnState() (bool, time.Time) {
+	aclLearnMu.Lock()
+	defer aclLearnMu.Unlock()
+	return atomic.LoadInt32(&aclLearning) == 1 && time.Now().Before(aclLearnUntil), aclLearnUntil
+}
@@ -0,0 +1,104 @@
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// aclPolicy restricts the zk acls clients may set on nodes under Prefix
+// with create and setAcl, for example
+//
+//	[{"prefix": "/dubbo", "deny_world_perms": "cdwa", "require_digest": ["admin"]}]
+//
+// DenyWorldPerms are the permissions world:anyone may not be given,
+// RequireDigest the digest users which must appear in every acl and Schemes,
+// if set, the only schemes allowed.
+type aclPolicy struct {
+	Prefix         string   `json:"prefix"`
+	DenyWorldPerms string   `json:"deny_world_perms"`
+	RequireDigest  []string `json:"require_digest"`
+	Schemes        []string `json:"schemes"`
+	denyWorld      int32
+}
+
+var (
+	aclPolicies       []*aclPolicy
+	aclPolicyRejected = expvar.NewInt("acl_policy_rejected")
+)
+
+// InitAclPolicy loads the policies enforced on create and setAcl from path.
+func InitAclPolicy(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	policies := []*aclPolicy{}
+	if err = json.Unmarshal(data, &policies); err != nil {
+		return err
+	}
+	for _, p := range policies {
+		if p.Prefix != "/" && !isValidAclPath(p.Prefix) {
+			return errors.New("invalid prefix " + p.Prefix)
+		}
+		if p.denyWorld, err = parsePerms(p.DenyWorldPerms); err != nil {
+			return err
+		}
+	}
+	aclPolicies = policies
+	glog.V(1).Infof("load %d acl policies from %s", len(policies), path)
+	return nil
+}
+
+func (p *aclPolicy) covers(path string) bool {
+	return p.Prefix == "/" || path == p.Prefix || strings.HasPrefix(path, p.Prefix+"/")
+}
+
+// check returns why acl breaks the policy, or "" if it does not.
+func (p *aclPolicy) check(acl []ACL) string {
+	users := make(map[string]bool)
+	for _, a := range acl {
+		if a.Scheme == "world" && a.ID == "anyone" && a.Perms&p.denyWorld != 0 {
+			return "world:anyone may not have " + formatPerms(a.Perms&p.denyWorld)
+		}
+		if len(p.Schemes) > 0 && !containsString(p.Schemes, a.Scheme) {
+			return "scheme " + a.Scheme + " is not allowed"
+		}
+		if a.Scheme == "digest" {
+			users[strings.SplitN(a.ID, ":", 2)[0]] = true
+		}
+	}
+	for _, user := range p.RequireDigest {
+		if !users[user] {
+			return "digest user " + user + " is required"
+		}
+	}
+	return ""
+}
+
+// checkAclPolicy returns why acl may not be set on path, or "" if it may.
+func checkAclPolicy(path string, acl []ACL) string {
+	for _, p := range aclPolicies {
+		if !p.covers(path) {
+			continue
+		}
+		if reason := p.check(acl); reason != "" {
+			aclPolicyRejected.Add(1)
+			return p.Prefix + ": " + reason
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package zk
+
+import (
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+var (
+	aclResyncInterval = 5 * time.Minute
+	aclRetryInterval  = 1 * time.Second
+	aclRefreshErrors  = expvar.NewInt("acl_refresh_errors")
+)
+
+// SetAclResyncInterval sets how often the acl cache is rebuilt from scratch
+// in case a watch event was lost.
+func SetAclResyncInterval(seconds int) {
+	aclResyncInterval = time.Duration(seconds) * time.Second
+	glog.V(1).Infof("set acl resync interval for %v", aclResyncInterval)
+}
+
+// aclWatcher keeps aclCache in sync with the nodes under permRoot. Every acl
+// node carries a data and a child watch, and the root carries a child watch
+// so new namespaces get their entry created. All state is owned by run.
+type aclWatcher struct {
+	events chan zk.Event
+	data   map[string]bool // nodes with a pending data watch
+	child  map[string]bool // nodes with a pending child watch
+	dirty  bool
+}
+
+func newAclWatcher() *aclWatcher {
+	return &aclWatcher{
+		events: make(chan zk.Event, 64),
+		data:   make(map[string]bool),
+		child:  make(map[string]bool),
+	}
+}
+
+func (w *aclWatcher) run() {
+	resync := time.NewTicker(aclResyncInterval)
+	retry := time.NewTicker(aclRetryInterval)
+	defer resync.Stop()
+	defer retry.Stop()
+	for {
+		select {
+		case ev := <-w.events:
+			w.handle(ev)
+		case <-resync.C:
+			w.resync()
+		case <-retry.C:
+			if w.dirty {
+				w.resync()
+			}
+		}
+	}
+}
+
+func (w *aclWatcher) forward(ch <-chan zk.Event) {
+	w.events <- <-ch
+}
+
+func (w *aclWatcher) getData(pp string) ([]byte, error) {
+	if w.data[pp] {
+		data, _, err := zkConn.Get(pp)
+		return data, err
+	}
+	data, _, ch, err := zkConn.GetW(pp)
+	if err != nil {
+		return nil, err
+	}
+	w.data[pp] = true
+	go w.forward(ch)
+	return data, nil
+}
+
+func (w *aclWatcher) getChildren(pp string) ([]string, error) {
+	if w.child[pp] {
+		children, _, err := zkConn.Children(pp)
+		return children, err
+	}
+	children, _, ch, err := zkConn.ChildrenW(pp)
+	if err != nil {
+		return nil, err
+	}
+	w.child[pp] = true
+	go w.forward(ch)
+	return children, nil
+}
+
+func (w *aclWatcher) handle(ev zk.Event) {
+	var err error
+	switch ev.Type {
+	case zk.EventNodeDataChanged:
+		delete(w.data, ev.Path)
+		err = w.reloadEntry(ev.Path)
+	case zk.EventNodeChildrenChanged:
+		delete(w.child, ev.Path)
+		if ev.Path == "/" {
+			err = w.ensureNamespaces()
+		} else {
+			err = w.reloadTree(ev.Path)
+		}
+	case zk.EventNodeDeleted:
+		delete(w.data, ev.Path)
+		delete(w.child, ev.Path)
+		if isPermPath(ev.Path) {
+			aclCache.replaceTree(aclEntryPath(ev.Path), nil)
+		}
+	case zk.EventNotWatching:
+		// the session expired and every watch is gone
+		w.data = make(map[string]bool)
+		w.child = make(map[string]bool)
+		w.dirty = true
+	}
+	if err != nil && err != zk.ErrNoNode {
+		glog.Errorf("refresh acl for %s on %s %v", ev.Path, ev.Type, err)
+		aclRefreshErrors.Add(1)
+		w.dirty = true
+	}
+}
+
+// resync rebuilds the whole cache and rearms any missing watch.
+func (w *aclWatcher) resync() {
+	err := w.ensureNamespaces()
+	if err == nil {
+		err = w.reloadTree(permRoot)
+	}
+	if err != nil {
+		glog.Errorf("resync acl %v", err)
+		aclRefreshErrors.Add(1)
+		w.dirty = true
+		return
+	}
+	w.dirty = false
+}
+
+// ensureNamespaces creates an empty entry for every top-level node, so a new
+// namespace is closed until it is whitelisted.
+func (w *aclWatcher) ensureNamespaces() error {
+	secondPath, err := w.getChildren("/")
+	if err != nil {
+		return err
+	}
+	for _, p := range secondPath {
+		p = "/" + p
+		if p == permRoot {
+			continue
+		}
+		pp := permRoot + p
+		_, err = zkConn.Create(pp, []byte("{}"), 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			glog.Errorf("create path %s %v", pp, err)
+		}
+	}
+	return nil
+}
+
+func (w *aclWatcher) reloadEntry(pp string) error {
+	data, err := w.getData(pp)
+	if err != nil {
+		return err
+	}
+	entry, err := decodeAclEntry(data)
+	if err != nil {
+		return err
+	}
+	aclCache.setEntry(aclEntryPath(pp), entry)
+	return nil
+}
+
+func (w *aclWatcher) reloadTree(pp string) error {
+	m := make(map[string]*aclEntry)
+	if err := w.loadTree(pp, m); err != nil {
+		return err
+	}
+	aclCache.replaceTree(aclEntryPath(pp), m)
+	return nil
+}
+
+// loadTree fills m with the entries of pp and the acl nodes below it, keyed
+// by the zk path they protect.
+func (w *aclWatcher) loadTree(pp string, m map[string]*aclEntry) error {
+	data, err := w.getData(pp)
+	if err != nil {
+		return err
+	}
+	entry, err := decodeAclEntry(data)
+	if err != nil {
+		glog.Errorf("load acl for path %s %v", pp, err)
+	} else if entry != nil {
+		m[aclEntryPath(pp)] = entry
+	}
+	children, err := w.getChildren(pp)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if pp == permRoot && isAclMetaNode(child) {
+			continue
+		}
+		if err = w.loadTree(pp+"/"+child, m); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+// aclEntryPath maps an acl node to the zk path it protects.
+func aclEntryPath(pp string) string {
+	if pp == permRoot {
+		return "/"
+	}
+	return strings.TrimPrefix(pp, permRoot)
+}
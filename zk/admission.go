@@ -0,0 +1,138 @@
+package zk
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// admission paces the handshakes of new sessions, so a zk server restart
+// does not turn every reconnecting client into a backend dial at once.
+// Handshakes wait in a bounded queue and are let through in arrival order as
+// tokens come in, reconnects of existing sessions first so their ephemeral
+// nodes survive.
+type admission struct {
+	mu         sync.Mutex
+	cond       *sync.Cond // signaled when a handshake is queued
+	bucket     *tokenBucket
+	maxQueue   int
+	timeout    time.Duration
+	reconnects *list.List // queued handshakes of existing sessions
+	news       *list.List // queued handshakes of new sessions
+}
+
+// admitWaiter is a queued handshake, ready is closed once it is admitted.
+type admitWaiter struct {
+	ready    chan struct{}
+	admitted bool
+}
+
+var (
+	admit             *admission
+	errAdmitQueueFull = errors.New("session admission queue full")
+	errAdmitTimeout   = errors.New("session admission timeout")
+	admitQueued       = expvar.NewInt("session_admit_queued")
+	admitRejected     = expvar.NewInt("session_admit_rejected")
+	admitTimeouts     = expvar.NewInt("session_admit_timeout")
+)
+
+// InitAdmission limits new session handshakes to rate per second, with at
+// most queue of them waiting up to timeout.
+func InitAdmission(rate, queue int, timeout time.Duration) {
+	admit = newAdmission(rate, queue, timeout)
+	glog.V(1).Infof("set session admission rate %d queue %d timeout %v", rate, queue, timeout)
+}
+
+func newAdmission(rate, queue int, timeout time.Duration) *admission {
+	a := &admission{
+		bucket:     newTokenBucket(rate),
+		maxQueue:   queue,
+		timeout:    timeout,
+		reconnects: list.New(),
+		news:       list.New(),
+	}
+	a.cond = sync.NewCond(&a.mu)
+	go a.dispatch()
+	return a
+}
+
+// admitSession waits until a handshake may go to the zk server.
+func admitSession(reconnect bool) error {
+	if admit == nil {
+		return nil
+	}
+	return admit.wait(reconnect)
+}
+
+func (a *admission) queued() int {
+	return a.reconnects.Len() + a.news.Len()
+}
+
+func (a *admission) wait(reconnect bool) error {
+	a.mu.Lock()
+	if a.queued() >= a.maxQueue {
+		a.mu.Unlock()
+		admitRejected.Add(1)
+		return errAdmitQueueFull
+	}
+	w := &admitWaiter{ready: make(chan struct{})}
+	q := a.news
+	if reconnect {
+		q = a.reconnects
+	}
+	e := q.PushBack(w)
+	admitQueued.Add(1)
+	a.cond.Signal()
+	a.mu.Unlock()
+
+	t := time.NewTimer(a.timeout)
+	defer t.Stop()
+	select {
+	case <-w.ready:
+		return nil
+	case <-t.C:
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if w.admitted {
+		return nil
+	}
+	q.Remove(e)
+	admitQueued.Add(-1)
+	admitTimeouts.Add(1)
+	return errAdmitTimeout
+}
+
+// dispatch admits the queued handshakes one token at a time, the oldest
+// reconnect first, then the oldest new session.
+func (a *admission) dispatch() {
+	for {
+		a.mu.Lock()
+		for a.queued() == 0 {
+			a.cond.Wait()
+		}
+		a.mu.Unlock()
+		if d := a.bucket.reserve(time.Now()); d > 0 {
+			time.Sleep(d)
+		}
+		a.mu.Lock()
+		q := a.reconnects
+		if q.Len() == 0 {
+			q = a.news
+		}
+		if e := q.Front(); e != nil {
+			w := q.Remove(e).(*admitWaiter)
+			w.admitted = true
+			close(w.ready)
+			admitQueued.Add(-1)
+		} else {
+			// every waiter timed out while the token was coming
+			a.bucket.refund()
+		}
+		a.mu.Unlock()
+	}
+}
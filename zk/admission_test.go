@@ -0,0 +1,54 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionOrder(t *testing.T) {
+	a := newAdmission(20, 5, time.Second)
+	for now := time.Now(); a.bucket.take(now); {
+	}
+	order := make(chan string, 10)
+	start := func(name string, reconnect bool) {
+		go func() {
+			if err := a.wait(reconnect); err != nil {
+				order <- name + " " + err.Error()
+				return
+			}
+			order <- name
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	start("new1", false)
+	start("new2", false)
+	start("new3", false)
+	start("reconnect", true)
+	start("new4", false)
+	start("full", false)
+	want := []string{"full session admission queue full", "reconnect", "new1", "new2", "new3", "new4"}
+	for _, name := range want {
+		select {
+		case got := <-order:
+			if got != name {
+				t.Fatalf("admitted %s, want %s", got, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not admitted", name)
+		}
+	}
+}
+
+func TestAdmissionTimeout(t *testing.T) {
+	a := newAdmission(1, 5, 20*time.Millisecond)
+	for now := time.Now(); a.bucket.take(now); {
+	}
+	if err := a.wait(false); err != errAdmitTimeout {
+		t.Fatalf("wait = %v, want %v", err, errAdmitTimeout)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n := a.queued(); n != 0 {
+		t.Fatalf("%d handshakes left queued", n)
+	}
+}
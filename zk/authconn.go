@@ -11,6 +11,7 @@ type AuthConn interface {
 	Read() (*AuthRequest, error)
 	Write(AuthResponse) (Conn, error)
 	WriteFlw(string, string) error
+	RemoteAddress() string
 	Close()
 }
 
@@ -54,6 +55,8 @@ func (ac *authConn) WriteFlw(flw, server string) error {
 	return ProxyFlw(ac.c, server, flw)
 }
 
+func (ac *authConn) RemoteAddress() string { return ac.c.RemoteAddr().String() }
+
 func (ac *authConn) Close() {
 	if ac.c != nil {
 		ac.c.Close()
@@ -0,0 +1,223 @@
+package zk
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// BreakerConfig sets when a zk server is considered unhealthy. Once at least
+// MinRequests responses in a Window are slower than Latency or failed with a
+// system error in the given Ratio, the breaker of the server opens: no new
+// session goes to it for Cooldown, and with Migrate its sessions are closed,
+// MigrateRate per second, so the clients reconnect to a healthy server. After
+// Cooldown the breaker is half-open: up to Probes new sessions go to the
+// server each Window until MinRequests responses decide whether it closes or
+// reopens.
+type BreakerConfig struct {
+	Latency     time.Duration
+	Ratio       float64
+	MinRequests int
+	Window      time.Duration
+	Cooldown    time.Duration
+	Probes      int
+	Migrate     bool
+	MigrateRate int // 0 closes every session at once
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// BackendState is the breaker of one zk server with its current window.
+type BackendState struct {
+	Addr       string    `json:"addr"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Requests   int       `json:"requests"`
+	Slow       int       `json:"slow"`
+	Errors     int       `json:"errors"`
+	AvgLatency float64   `json:"avg_latency_ms"`
+}
+
+type backendBreaker struct {
+	mu      sync.Mutex
+	state   BackendState
+	window  time.Time
+	latency time.Duration // sum over the window
+	probes  int           // sessions let through in the half-open window
+}
+
+var (
+	breakerConf *BreakerConfig
+	breakersMu  sync.Mutex
+	breakers    = make(map[string]*backendBreaker)
+)
+
+// SetBreaker enables the circuit breakers of the zk servers.
+func SetBreaker(conf BreakerConfig) {
+	if conf.Probes <= 0 {
+		conf.Probes = 1
+	}
+	breakerConf = &conf
+	glog.V(1).Infof("set backend breaker %+v", conf)
+}
+
+func getBreaker(addr string) *backendBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[addr]
+	if !ok {
+		now := time.Now()
+		b = &backendBreaker{state: BackendState{Addr: addr, State: breakerClosed, Since: now}, window: now}
+		breakers[addr] = b
+	}
+	return b
+}
+
+func (b *backendBreaker) reset(state string, now time.Time) {
+	if state != b.state.State {
+		glog.Warningf("backend %s breaker %s after %d requests %d slow %d errors", b.state.Addr, state, b.state.Requests, b.state.Slow, b.state.Errors)
+		b.state.State = state
+		b.state.Since = now
+	}
+	b.state.Requests, b.state.Slow, b.state.Errors = 0, 0, 0
+	b.state.AvgLatency = 0
+	b.latency = 0
+	b.window = now
+	b.probes = 0
+}
+
+// allow reports whether a new session may go to the server. A half-open
+// server gets a few probe sessions per window, and a new lot if the window
+// passes without a decision.
+func (b *backendBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state.State {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if now.Sub(b.state.Since) < breakerConf.Cooldown {
+			return false
+		}
+		b.reset(breakerHalfOpen, now)
+	case breakerHalfOpen:
+		if now.Sub(b.window) > breakerConf.Window {
+			b.probes = 0
+			b.window = now
+		}
+	}
+	if b.probes >= breakerConf.Probes {
+		return false
+	}
+	b.probes++
+	return true
+}
+
+// observe records one response, or a failed dial, and returns whether it
+// opened the breaker.
+func (b *backendBreaker) observe(latency time.Duration, failed bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state.State == breakerOpen {
+		return false
+	}
+	if b.state.State == breakerClosed && now.Sub(b.window) > breakerConf.Window {
+		b.reset(breakerClosed, now)
+	}
+	b.state.Requests++
+	b.latency += latency
+	b.state.AvgLatency = float64(b.latency) / float64(b.state.Requests) / float64(time.Millisecond)
+	if failed {
+		b.state.Errors++
+	} else if latency >= breakerConf.Latency {
+		b.state.Slow++
+	}
+	if b.state.Requests < breakerConf.MinRequests {
+		return false
+	}
+	if float64(b.state.Slow+b.state.Errors) >= breakerConf.Ratio*float64(b.state.Requests) {
+		b.reset(breakerOpen, now)
+		return true
+	}
+	if b.state.State == breakerHalfOpen {
+		b.reset(breakerClosed, now)
+	}
+	return false
+}
+
+func (b *backendBreaker) snapshot() BackendState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// backendAllowed reports whether a new session may go to addr.
+func backendAllowed(addr string) bool {
+	if breakerConf == nil {
+		return true
+	}
+	return getBreaker(addr).allow(time.Now())
+}
+
+// observeBackend feeds the breaker of addr.
+func observeBackend(addr string, latency time.Duration, failed bool) {
+	if breakerConf == nil {
+		return
+	}
+	if b := getBreaker(addr); b.observe(latency, failed, time.Now()) && breakerConf.Migrate {
+		go migrateSessions(b, breakerConf.MigrateRate)
+	}
+}
+
+// migrateSessions closes the sessions served by the server of b, rate of
+// them per second, so their clients reconnect with the same session id to
+// another server without all landing at once. It stops if the breaker
+// closes in the meantime.
+func migrateSessions(b *backendBreaker, rate int) {
+	addr := b.snapshot().Addr
+	var ss []*session
+	for item := range activeSessions.IterBuffered() {
+		if s, ok := item.Val.(*session); ok && s.backend == addr {
+			ss = append(ss, s)
+		}
+	}
+	glog.Warningf("migrate %d sessions off backend %s", len(ss), addr)
+	for i, s := range ss {
+		if rate > 0 && i > 0 && i%rate == 0 {
+			time.Sleep(time.Second)
+			if b.snapshot().State != breakerOpen {
+				glog.Warningf("stop migrating sessions off backend %s after %d", addr, i)
+				return
+			}
+		}
+		s.SClose()
+	}
+}
+
+// isServerError reports whether code is a zookeeper system error rather than
+// an error of the request itself.
+func isServerError(code ErrCode) bool {
+	return code < errOk && code > errAPIError
+}
+
+// ListBackends returns the breaker of every zk server seen so far.
+func ListBackends() []BackendState {
+	breakersMu.Lock()
+	bs := make([]*backendBreaker, 0, len(breakers))
+	for _, b := range breakers {
+		bs = append(bs, b)
+	}
+	breakersMu.Unlock()
+	states := make([]BackendState, 0, len(bs))
+	for _, b := range bs {
+		states = append(states, b.snapshot())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Addr < states[j].Addr })
+	return states
+}
@@ -0,0 +1,55 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	saved := breakerConf
+	breakerConf = &BreakerConfig{
+		Latency:     100 * time.Millisecond,
+		Ratio:       0.5,
+		MinRequests: 2,
+		Window:      10 * time.Second,
+		Cooldown:    30 * time.Second,
+		Probes:      2,
+	}
+	defer func() { breakerConf = saved }()
+
+	now := time.Now()
+	b := &backendBreaker{state: BackendState{Addr: "zk1:2181", State: breakerClosed, Since: now}, window: now}
+	b.observe(time.Second, false, now)
+	if !b.observe(0, true, now) {
+		t.Fatal("breaker did not open")
+	}
+	steps := []struct {
+		after time.Duration
+		allow bool
+		state string
+	}{
+		{time.Second, false, breakerOpen},
+		{30 * time.Second, true, breakerHalfOpen},
+		{0, true, breakerHalfOpen},
+		{0, false, breakerHalfOpen},
+		{5 * time.Second, false, breakerHalfOpen},
+		// a window without a decision lets a new lot of probes through
+		{6 * time.Second, true, breakerHalfOpen},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		if got := b.allow(now); got != s.allow || b.snapshot().State != s.state {
+			t.Fatalf("step %d: allow = %v in %s, want %v in %s", i, got, b.snapshot().State, s.allow, s.state)
+		}
+	}
+	b.observe(time.Millisecond, false, now)
+	b.observe(time.Millisecond, false, now)
+	if state := b.snapshot().State; state != breakerClosed {
+		t.Fatalf("breaker %s after healthy probes, want closed", state)
+	}
+	for i := 0; i < 5; i++ {
+		if !b.allow(now) {
+			t.Fatal("closed breaker refused a session")
+		}
+	}
+}
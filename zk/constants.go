@@ -23,6 +23,7 @@ const (
 	opCheck        = 13
 	opMulti        = 14
 
+	opError      = -1
 	opClose      = -11
 	opSetAuth    = 100
 	opSetWatches = 101
@@ -43,6 +44,15 @@ const (
 	EventNotWatching = EventType(-2)
 )
 
+const (
+	PermRead = 1 << iota
+	PermWrite
+	PermCreate
+	PermDelete
+	PermAdmin
+	PermAll = 0x1f
+)
+
 const (
 	FlagEphemeral = 1
 	FlagSequence  = 2
@@ -85,6 +95,7 @@ var (
 
 	ErrBadArguments   = errors.New("zk: bad arguments")
 	ErrFourLetterWord = errors.New("four letter word reponse")
+	ErrSessionHijack  = errors.New("session reconnect from another ip")
 
 	errorToErrCode = map[error]ErrCode{
 		ErrBadArguments: errBadArguments,
@@ -124,4 +135,5 @@ const (
 	errClosing                 = ErrCode(-116)
 	errNothing                 = ErrCode(-117)
 	errSessionMoved            = ErrCode(-118)
+	errQuotaExceeded           = ErrCode(-125)
 )
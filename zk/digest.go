@@ -0,0 +1,113 @@
+package zk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// authXid is the xid zookeeper clients use for auth packets, the server
+// answers with the same xid. Requests from clients never use it.
+const authXid = Xid(-4)
+
+// digestRule gives the clients matching an ip or cidr a zk identity, which
+// the proxy adds to their server connection, for example
+//
+//	[{"match": "10.0.0.0/8", "scheme": "digest", "auth": "user:password"}]
+type digestRule struct {
+	Match  string `json:"match"`
+	Scheme string `json:"scheme"`
+	Auth   string `json:"auth"`
+	ipnet  *net.IPNet
+}
+
+var digestRules []*digestRule
+
+// InitDigestAuth loads the credentials injected for clients from path.
+func InitDigestAuth(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rules := []*digestRule{}
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Scheme == "" {
+			rule.Scheme = "digest"
+		}
+		if rule.Auth == "" {
+			return errors.New("empty auth for " + rule.Match)
+		}
+		if rule.ipnet, err = parseIPNet(rule.Match); err != nil {
+			return err
+		}
+	}
+	digestRules = rules
+	glog.V(1).Infof("load %d digest auth rules from %s", len(rules), path)
+	return nil
+}
+
+// parseIPNet parses a cidr, or a single ip as the network of itself.
+func parseIPNet(match string) (*net.IPNet, error) {
+	if !strings.Contains(match, "/") {
+		if ip := net.ParseIP(match); ip != nil && ip.To4() != nil {
+			match += "/32"
+		} else {
+			match += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(match)
+	return ipnet, err
+}
+
+// matchDigestRule returns the most specific rule for ipaddr, or nil.
+func matchDigestRule(ipaddr string) *digestRule {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return nil
+	}
+	var best *digestRule
+	bestOnes := -1
+	for _, rule := range digestRules {
+		if !rule.ipnet.Contains(ip) {
+			continue
+		}
+		if ones, _ := rule.ipnet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = rule, ones
+		}
+	}
+	return best
+}
+
+// injectAuth authenticates a fresh server connection before any client
+// request goes through it.
+func injectAuth(zkConn net.Conn, rule *digestRule) error {
+	req := &SetAuthRequest{Type: 0, Scheme: rule.Scheme, Auth: []byte(rule.Auth)}
+	buf, err := encodeRequest(authXid, opSetAuth, req, 64+len(rule.Scheme)+len(rule.Auth))
+	if err != nil {
+		return err
+	}
+	pkt := make([]byte, 4, 4+len(buf))
+	binary.BigEndian.PutUint32(pkt, uint32(len(buf)))
+	if _, err = zkConn.Write(append(pkt, buf...)); err != nil {
+		return err
+	}
+	hdr := &ResponseHeader{}
+	if _, err = ReadPacket(zkConn, hdr); err != nil {
+		return err
+	}
+	if hdr.Xid != authXid {
+		return errors.New("unexpected response to auth packet")
+	}
+	if hdr.Err != errOk {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -301,6 +301,8 @@ func (r *MultiResponse) Encode(buf []byte) (int, error) {
 			n, err = encodePacketValue(buf[total:], reflect.ValueOf(op.String))
 		case opSetData:
 			n, err = encodePacketValue(buf[total:], reflect.ValueOf(op.Stat))
+		case opError:
+			n, err = encodePacketValue(buf[total:], reflect.ValueOf(op.Header.Err))
 		}
 		total += n
 		if err != nil {
@@ -342,6 +344,8 @@ func (r *MultiResponse) Decode(buf []byte) (int, error) {
 		case opSetData:
 			res.Stat = new(Stat)
 			w = reflect.ValueOf(res.Stat)
+		case opError:
+			w = reflect.ValueOf(&res.Header.Err)
 		case opCheck, opDelete:
 		}
 		if w.IsValid() {
@@ -420,3 +424,39 @@ func generateErrResp(xid Xid, errcode ErrCode) ([]byte, error) {
 	}
 	return buf, nil
 }
+
+// generateMultiErrResp answers a multi of n ops whose op at index failed
+// with errcode, the way zookeeper reports an aborted transaction.
+func generateMultiErrResp(xid Xid, n int, failed int, errcode ErrCode) ([]byte, error) {
+	resp := &MultiResponse{
+		Ops:        make([]MultiResponseOp, n),
+		DoneHeader: MultiHeader{Type: opError, Done: true, Err: -1},
+	}
+	for i := range resp.Ops {
+		resp.Ops[i].Header = MultiHeader{Type: opError, Err: errOk}
+		if i == failed {
+			resp.Ops[i].Header.Err = errcode
+		} else if i > failed {
+			resp.Ops[i].Header.Err = errRuntimeInconsistency
+		}
+	}
+	buf := make([]byte, 16+13*(n+1))
+	hdr := &ResponseHeader{Xid: xid}
+	n1, err := encodePacket(buf, hdr)
+	if err != nil {
+		return buf, err
+	}
+	n2, err := encodePacket(buf[n1:], resp)
+	return buf[:n1+n2], err
+}
+
+// encodeRequest serializes a request with its header into a buffer of size.
+func encodeRequest(xid Xid, op Op, req interface{}, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n1, err := encodePacket(buf, &requestHeader{Xid: xid, Opcode: op})
+	if err != nil {
+		return buf, err
+	}
+	n2, err := encodePacket(buf[n1:], req)
+	return buf[:n1+n2], err
+}
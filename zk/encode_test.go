@@ -0,0 +1,51 @@
+package zk
+
+import "testing"
+
+func TestGenerateMultiErrResp(t *testing.T) {
+	tests := []struct {
+		n      int
+		failed int
+		code   ErrCode
+	}{
+		{1, 0, errNoAuth},
+		{3, 0, errQuotaExceeded},
+		{3, 1, errNoAuth},
+		{3, 2, errInvalidAcl},
+	}
+	for _, tt := range tests {
+		buf, err := generateMultiErrResp(Xid(7), tt.n, tt.failed, tt.code)
+		if err != nil {
+			t.Fatalf("generateMultiErrResp(%d, %d) %v", tt.n, tt.failed, err)
+		}
+		if want := 16 + 13*tt.n + 9; len(buf) != want {
+			t.Errorf("generateMultiErrResp(%d, %d) is %d bytes, want %d", tt.n, tt.failed, len(buf), want)
+		}
+		hdr := &ResponseHeader{}
+		n, err := decodePacket(buf, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Xid != 7 || hdr.Err != errOk {
+			t.Errorf("header = %+v, want xid 7 and no error", hdr)
+		}
+		resp := &MultiResponse{}
+		if _, err := decodePacket(buf[n:], resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Ops) != tt.n || !resp.DoneHeader.Done {
+			t.Fatalf("decoded %d ops done %v, want %d ops", len(resp.Ops), resp.DoneHeader.Done, tt.n)
+		}
+		for i, op := range resp.Ops {
+			want := errOk
+			if i == tt.failed {
+				want = tt.code
+			} else if i > tt.failed {
+				want = errRuntimeInconsistency
+			}
+			if op.Header.Type != opError || op.Header.Err != want {
+				t.Errorf("op %d of %d = %+v, want error %d", i, tt.n, op.Header, want)
+			}
+		}
+	}
+}
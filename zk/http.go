@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"expvar"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,15 +15,34 @@ import (
 )
 
 type respBody struct {
-	Code int    `json:"code"`
-	Err  string `json:"err"`
-	Msg  string `json:"msg"`
+	Code int         `json:"code"`
+	Err  string      `json:"err"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
 }
 
 func StartHttp(apiAddr string) {
 	http.HandleFunc("/api/v1/whitelist/add", AddIpWhitelist)
 	http.HandleFunc("/api/v1/whitelist/del", DelIpWhitelist)
 	http.HandleFunc("/api/v1/whitelist/list", ListIpWhitelist)
+	http.HandleFunc("/api/v1/whitelist/inherit", SetIpWhitelistInherit)
+	http.HandleFunc("/api/v1/denylist/add", AddIpDenylist)
+	http.HandleFunc("/api/v1/denylist/del", DelIpDenylist)
+	http.HandleFunc("/api/v1/denylist/list", ListIpDenylist)
+	http.HandleFunc("/api/v1/acl/denials", ListAclDenial)
+	http.HandleFunc("/api/v1/acl/history", ListIpAclHistory)
+	http.HandleFunc("/api/v1/acl/rollback", RollbackIpWhitelist)
+	http.HandleFunc("/api/v1/acl/simulate", SimulateIpAclRequest)
+	http.HandleFunc("/api/v1/acl/export", ExportIpAclSet)
+	http.HandleFunc("/api/v1/acl/import", ImportIpAclSet)
+	http.HandleFunc("/api/v1/acl/learn/start", StartIpAclLearn)
+	http.HandleFunc("/api/v1/acl/learn/stop", StopIpAclLearn)
+	http.HandleFunc("/api/v1/acl/learn/export", ExportIpAclLearn)
+	http.HandleFunc("/api/v1/limit/list", ListRateLimit)
+	http.HandleFunc("/api/v1/limit/reload", ReloadRateLimit)
+	http.HandleFunc("/api/v1/limit/rejects", ListRateLimitRejects)
+	http.HandleFunc("/api/v1/limit/quota", ListWriteQuota)
+	http.HandleFunc("/api/v1/backend/list", ListBackend)
 	srv := &http.Server{
 		Addr:         apiAddr,
 		WriteTimeout: 3 * time.Second,
@@ -45,40 +66,73 @@ func GetMetric(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "\n}\n")
 }
 
-func AddIpWhitelist(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	resp := respBody{}
+// parseIpListArgs reads the path and iplist args shared by the whitelist and
+// denylist apis. A non empty message is returned for invalid args.
+func parseIpListArgs(r *http.Request, validPath func(string) bool) (string, []string, string) {
 	r.ParseForm()
 	pathArg, found1 := r.Form["path"]
 	iplistArg, found2 := r.Form["iplist"]
 
 	if !(found1 && found2) {
-		resp.Code = -1
-		resp.Err = "invalid input args"
-		fmt.Fprint(w, marshalResp(resp))
-		return
+		return "", nil, "invalid input args"
 	}
 	path := pathArg[0]
-	iplist := iplistArg[0]
-	if !strings.HasPrefix(path, "/") || strings.Count(path, "/") != 1 {
+	if !validPath(path) {
+		return "", nil, "invalid input args: path"
+	}
+	ipaddrs := []string{}
+	for _, ip := range strings.Split(iplistArg[0], ",") {
+		if net.ParseIP(ip) == nil {
+			return "", nil, "invalid input args: " + ip
+		}
+		ipaddrs = append(ipaddrs, ip)
+	}
+	return path, ipaddrs, ""
+}
+
+// parseTtlArg reads the optional ttl arg in seconds, 0 means no expiry.
+func parseTtlArg(r *http.Request) (time.Duration, bool) {
+	ttlArg, ok := r.Form["ttl"]
+	if !ok {
+		return 0, true
+	}
+	ttl, err := strconv.Atoi(ttlArg[0])
+	if err != nil || ttl < 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+func AddIpWhitelist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	path, ipaddrs, errMsg := parseIpListArgs(r, isValidAclPath)
+	if errMsg != "" {
 		resp.Code = -1
-		resp.Err = "invalid input args: path"
+		resp.Err = errMsg
 		fmt.Fprint(w, marshalResp(resp))
 		return
 	}
-	ipaddrs := []string{}
-	for _, ip := range strings.Split(iplist, ",") {
-		if net.ParseIP(ip) == nil {
+	perms := int32(PermAll)
+	if permsArg, ok := r.Form["perms"]; ok {
+		var perr error
+		perms, perr = parsePerms(permsArg[0])
+		if perr != nil || perms == 0 {
 			resp.Code = -1
-			resp.Err = "invalid input args: " + ip
+			resp.Err = "invalid input args: perms"
 			fmt.Fprint(w, marshalResp(resp))
 			return
-		} else {
-			ipaddrs = append(ipaddrs, ip)
 		}
 	}
-	err := AddIpAcl(path, ipaddrs)
-	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%s] [Err:%v]", r.RemoteAddr, r.RequestURI, path, iplist, err)
+	ttl, ok := parseTtlArg(r)
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args: ttl"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	err := AddIpAcl(path, ipaddrs, perms, ttl, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%v] [Perms:%s] [TTL:%v] [Err:%v]", r.RemoteAddr, r.RequestURI, path, ipaddrs, formatPerms(perms), ttl, err)
 	if err != nil {
 		resp.Code = 1
 		resp.Err = err.Error()
@@ -91,11 +145,146 @@ func AddIpWhitelist(w http.ResponseWriter, r *http.Request) {
 }
 
 func DelIpWhitelist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	path, ipaddrs, errMsg := parseIpListArgs(r, isValidAclPath)
+	if errMsg != "" {
+		resp.Code = -1
+		resp.Err = errMsg
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	err := DelIpAcl(path, ipaddrs, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%v] [Err:%v]", r.RemoteAddr, r.RequestURI, path, ipaddrs, err)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListIpWhitelist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	pathArg, ok := r.URL.Query()["path"]
+
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	path := pathArg[0]
+	entry, err := ListIpAcl(path)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	ipList := []string{}
+	permList := make(map[string]string, len(entry.Ips))
+	for ip, perms := range entry.Ips {
+		ipList = append(ipList, ip)
+		permList[ip] = formatPerms(int32(perms))
+	}
+	resp.Code = 0
+	resp.Msg = strings.Join(ipList, ",")
+	resp.Data = map[string]interface{}{"inherit": entry.Inherit, "perms": permList, "expires": entry.Expires}
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func AddIpDenylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	path, ipaddrs, errMsg := parseIpListArgs(r, isValidDenyPath)
+	if errMsg != "" {
+		resp.Code = -1
+		resp.Err = errMsg
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	ttl, ok := parseTtlArg(r)
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args: ttl"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	err := AddIpDeny(path, ipaddrs, ttl, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%v] [TTL:%v] [Err:%v]", r.RemoteAddr, r.RequestURI, path, ipaddrs, ttl, err)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func DelIpDenylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	path, ipaddrs, errMsg := parseIpListArgs(r, isValidDenyPath)
+	if errMsg != "" {
+		resp.Code = -1
+		resp.Err = errMsg
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	err := DelIpDeny(path, ipaddrs, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%v] [Err:%v]", r.RemoteAddr, r.RequestURI, path, ipaddrs, err)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListIpDenylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	pathArg, ok := r.URL.Query()["path"]
+
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	entry, err := ListIpAcl(pathArg[0])
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	ipList := []string{}
+	for ip := range entry.Deny {
+		ipList = append(ipList, ip)
+	}
+	resp.Code = 0
+	resp.Msg = strings.Join(ipList, ",")
+	resp.Data = map[string]interface{}{"expires": entry.Deny}
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func SetIpWhitelistInherit(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	resp := respBody{}
 	r.ParseForm()
 	pathArg, found1 := r.Form["path"]
-	iplistArg, found2 := r.Form["iplist"]
+	inheritArg, found2 := r.Form["inherit"]
 
 	if !(found1 && found2) {
 		resp.Code = -1
@@ -104,26 +293,21 @@ func DelIpWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	path := pathArg[0]
-	iplist := iplistArg[0]
-	if !strings.HasPrefix(path, "/") || strings.Count(path, "/") != 1 {
+	if !isValidAclPath(path) {
 		resp.Code = -1
 		resp.Err = "invalid input args: path"
 		fmt.Fprint(w, marshalResp(resp))
 		return
 	}
-	ipaddrs := []string{}
-	for _, ip := range strings.Split(iplist, ",") {
-		if net.ParseIP(ip) == nil {
-			resp.Code = -1
-			resp.Err = "invalid input args: " + ip
-			fmt.Fprint(w, marshalResp(resp))
-			return
-		} else {
-			ipaddrs = append(ipaddrs, ip)
-		}
+	inherit, perr := strconv.ParseBool(inheritArg[0])
+	if perr != nil {
+		resp.Code = -1
+		resp.Err = "invalid input args: inherit"
+		fmt.Fprint(w, marshalResp(resp))
+		return
 	}
-	err := DelIpAcl(path, ipaddrs)
-	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [IPList:%s] [Err:%v]", r.RemoteAddr, r.RequestURI, path, iplist, err)
+	err := SetIpAclInherit(path, inherit, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [Inherit:%v] [Err:%v]", r.RemoteAddr, r.RequestURI, path, inherit, err)
 	if err != nil {
 		resp.Code = 1
 		resp.Err = err.Error()
@@ -135,7 +319,28 @@ func DelIpWhitelist(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, marshalResp(resp))
 }
 
-func ListIpWhitelist(w http.ResponseWriter, r *http.Request) {
+func ListAclDenial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	if !enableIPAcl {
+		resp.Code = 1
+		resp.Err = errNotEnableAcl.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "enforce"
+	if aclShadow {
+		resp.Msg = "shadow"
+	}
+	resp.Data = ListAclDenials()
+	if reset, _ := strconv.ParseBool(r.URL.Query().Get("reset")); reset {
+		ResetAclDenials()
+	}
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListIpAclHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	resp := respBody{}
 	pathArg, ok := r.URL.Query()["path"]
@@ -146,8 +351,47 @@ func ListIpWhitelist(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, marshalResp(resp))
 		return
 	}
+	history, err := ListAclHistory(pathArg[0])
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Data = history
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func RollbackIpWhitelist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	r.ParseForm()
+	pathArg, found1 := r.Form["path"]
+	versionArg, found2 := r.Form["version"]
+
+	if !(found1 && found2) {
+		resp.Code = -1
+		resp.Err = "invalid input args"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
 	path := pathArg[0]
-	ipList, err := ListIpAcl(path)
+	if !isValidDenyPath(path) {
+		resp.Code = -1
+		resp.Err = "invalid input args: path"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	version, perr := strconv.ParseInt(versionArg[0], 10, 64)
+	if perr != nil {
+		resp.Code = -1
+		resp.Err = "invalid input args: version"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	err := RollbackIpAcl(path, version, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Path:%s] [Version:%d] [Err:%v]", r.RemoteAddr, r.RequestURI, path, version, err)
 	if err != nil {
 		resp.Code = 1
 		resp.Err = err.Error()
@@ -155,7 +399,223 @@ func ListIpWhitelist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	resp.Code = 0
-	resp.Msg = strings.Join(ipList, ",")
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func SimulateIpAclRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	args := r.URL.Query()
+	ip, path, opArg := args.Get("ip"), args.Get("path"), args.Get("op")
+
+	if ip == "" || path == "" || opArg == "" {
+		resp.Code = -1
+		resp.Err = "invalid input args"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	if net.ParseIP(ip) == nil {
+		resp.Code = -1
+		resp.Err = "invalid input args: " + ip
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	op, ok := parseOpName(opArg)
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args: op"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	d := SimulateIpAcl(path, ip, op)
+	resp.Code = 0
+	resp.Msg = "deny"
+	if d.Allowed {
+		resp.Msg = "allow"
+	} else if aclShadow {
+		resp.Msg = "deny (shadow, forwarded)"
+	}
+	resp.Data = d
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ExportIpAclSet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	m, err := ExportIpAcl()
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Data = m
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+// ImportIpAclSet takes an acl document as the request body, either a bare
+// map of paths to entries or the whole response of ExportIpAclSet.
+func ImportIpAclSet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	if r.Method != http.MethodPost {
+		resp.Code = -1
+		resp.Err = "invalid method: " + r.Method
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	args := r.URL.Query()
+	replace, _ := strconv.ParseBool(args.Get("replace"))
+	dryRun, _ := strconv.ParseBool(args.Get("dry_run"))
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		resp.Code = -1
+		resp.Err = "invalid input body: " + err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	changes, err := ImportIpAcl(data, replace, dryRun, r.RemoteAddr)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Replace:%v] [DryRun:%v] [Changes:%d] [Err:%v]", r.RemoteAddr, r.RequestURI, replace, dryRun, len(changes), err)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "success"
+	resp.Data = changes
+	if dryRun {
+		resp.Msg = "dry run"
+	}
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func StartIpAclLearn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	r.ParseForm()
+	windowArg, ok := r.Form["window"]
+
+	if !ok {
+		resp.Code = -1
+		resp.Err = "invalid input args"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	window, err := strconv.Atoi(windowArg[0])
+	if err != nil || window <= 0 {
+		resp.Code = -1
+		resp.Err = "invalid input args: window"
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	depth := 1
+	if depthArg, ok := r.Form["depth"]; ok {
+		depth, err = strconv.Atoi(depthArg[0])
+		if err != nil || depth <= 0 {
+			resp.Code = -1
+			resp.Err = "invalid input args: depth"
+			fmt.Fprint(w, marshalResp(resp))
+			return
+		}
+	}
+	StartAclLearn(time.Duration(window)*time.Second, depth)
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Window:%d] [Depth:%d]", r.RemoteAddr, r.RequestURI, window, depth)
+	resp.Code = 0
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func StopIpAclLearn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	StopAclLearn()
+	glog.V(1).Infof("[Client:%s] [URI:%s]", r.RemoteAddr, r.RequestURI)
+	resp.Code = 0
+	resp.Msg = "success"
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ExportIpAclLearn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	proposals, err := ExportAclLearn()
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	learning, until := AclLearnState()
+	resp.Code = 0
+	resp.Msg = "stopped"
+	if learning {
+		resp.Msg = "learning until " + until.Format(time.RFC3339)
+	}
+	resp.Data = proposals
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListRateLimit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	resp.Code = 0
+	resp.Data = ListLimit()
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ReloadRateLimit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	err := ReloadLimit()
+	glog.V(1).Infof("[Client:%s] [URI:%s] [Err:%v]", r.RemoteAddr, r.RequestURI, err)
+	if err != nil {
+		resp.Code = 1
+		resp.Err = err.Error()
+		fmt.Fprint(w, marshalResp(resp))
+		return
+	}
+	resp.Code = 0
+	resp.Msg = "success"
+	resp.Data = ListLimit()
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListRateLimitRejects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	resp.Code = 0
+	resp.Msg = "wait"
+	if ListLimit().Reject {
+		resp.Msg = "reject"
+	}
+	resp.Data = ListLimitRejects()
+	if reset, _ := strconv.ParseBool(r.URL.Query().Get("reset")); reset {
+		ResetLimitRejects()
+	}
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListWriteQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	resp.Code = 0
+	resp.Data = ListQuotaUsage()
+	fmt.Fprint(w, marshalResp(resp))
+}
+
+func ListBackend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp := respBody{}
+	resp.Code = 0
+	resp.Msg = "breaker disabled"
+	if breakerConf != nil {
+		resp.Msg = "breaker enabled"
+	}
+	resp.Data = ListBackends()
 	fmt.Fprint(w, marshalResp(resp))
 }
 
@@ -0,0 +1,462 @@
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The limit file sets request rates per second, for example
+//
+//	{
+//	    "global": 5000,
+//	    "client": 200,
+//	    "clients": {"10.0.0.1": 1000},
+//	    "paths": {"/dubbo": 2000},
+//	    "ops": {"read": 4000, "write": 500},
+//	    "namespaces": {"/dubbo": {"read": 1000, "write": 100, "write_hourly": 50000, "write_daily": 500000,
+//	        "max_data_size": 65536, "max_nodes": 100000}}
+//	}
+//
+// Client is the default rate of every client ip, clients overrides it for
+// some of them. A request is charged to the longest path prefix it falls under
+// and to the class of its op, each op of a multi as a request of its own.
+// Namespaces set read and write rates and write quotas of a path prefix on
+// their own. Zero or missing rates are not limited. Rates and quotas are
+// counted in memory by each proxy, so a fleet of n proxies lets n times as
+// much through, and a restart starts the quotas afresh.
+//
+// Requests over the limit wait for a token, unless reject is set and they are
+// answered at once with reject_code, errOperationTimeout by default. A request
+// which would wait longer than max_wait ms, 1000 by default, is answered with
+// reject_code as well. Writes over a quota or breaking max_data_size or
+// max_nodes are answered with quota_code, errQuotaExceeded by default. The
+// quotas are only charged once every other check let the write through.
+//
+// The bucket of a client ip is dropped once it has been idle for limitIdle.
+// Past limitMaxIdle clients, new ones share a single bucket of the default
+// rate until older ones go idle.
+type LimitConfig struct {
+	Global     int                       `json:"global"`
+	Client     int                       `json:"client"`
+	Clients    map[string]int            `json:"clients,omitempty"`
+	Paths      map[string]int            `json:"paths,omitempty"`
+	Ops        map[string]int            `json:"ops,omitempty"`
+	Namespaces map[string]NamespaceLimit `json:"namespaces,omitempty"`
+	Reject     bool                      `json:"reject"`
+	RejectCode ErrCode                   `json:"reject_code,omitempty"`
+	QuotaCode  ErrCode                   `json:"quota_code,omitempty"`
+	MaxWait    int                       `json:"max_wait,omitempty"`
+}
+
+// NamespaceLimit sets the budgets of one namespace. Writes over the hourly or
+// daily quota of a proxy are rejected until the hour or day is over. Creates
+// and sets with more than MaxDataSize bytes of data are rejected, and so are
+// creates once the namespace holds MaxNodes nodes, counted as limitnode.go
+// describes.
+type NamespaceLimit struct {
+	Read        int   `json:"read"`
+	Write       int   `json:"write"`
+	WriteHourly int64 `json:"write_hourly"`
+	WriteDaily  int64 `json:"write_daily"`
+	MaxDataSize int   `json:"max_data_size"`
+	MaxNodes    int64 `json:"max_nodes"`
+}
+
+var (
+	limitFile     string
+	limitGlobal   = 0          // set by -limit_num, used if the file has no global rate
+	limitReject   = ErrCode(0) // set by -limit_reject_code, used if the file does not reject
+	limitMu       sync.Mutex
+	limits        *rateLimits
+	limitMaxIdle  = 10000 // client buckets kept before new clients share one
+	limitIdle     = 1 * time.Minute
+	limitMaxWait  = 1000 // ms, used if the file sets no max_wait
+	errNoLimit    = errors.New("limit file not set")
+	limitOpsClass = []string{"read", "write"}
+)
+
+// tokenBucket refills rate tokens per second up to a burst of one second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// reserve takes a token, going into debt if there is none, and returns how
+// long the caller has to wait for it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes a token if there is one.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// idle reports whether the bucket has not been used for d.
+func (b *tokenBucket) idle(now time.Time, d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last) >= d
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.rate
+}
+
+// rateLimits holds the buckets built from one LimitConfig. A reload replaces
+// it as a whole.
+type rateLimits struct {
+	conf     LimitConfig
+	global   *tokenBucket
+	paths    map[string]*tokenBucket
+	ops      map[string]*tokenBucket
+	reads    map[string]*tokenBucket // by namespace
+	writes   map[string]*tokenBucket // by namespace
+	mu       sync.Mutex
+	clients  map[string]*tokenBucket
+	overflow *tokenBucket // shared by the clients past limitMaxIdle
+	pruned   time.Time
+}
+
+func newRateLimits(conf LimitConfig) *rateLimits {
+	if conf.Global == 0 {
+		conf.Global = limitGlobal
+	}
+	if !conf.Reject && limitReject != 0 {
+		conf.Reject = true
+		conf.RejectCode = limitReject
+	}
+	if conf.RejectCode == 0 {
+		conf.RejectCode = errOperationTimeout
+	}
+	if conf.QuotaCode == 0 {
+		conf.QuotaCode = errQuotaExceeded
+	}
+	if conf.MaxWait == 0 {
+		conf.MaxWait = limitMaxWait
+	}
+	rl := &rateLimits{
+		conf:    conf,
+		paths:   make(map[string]*tokenBucket),
+		ops:     make(map[string]*tokenBucket),
+		reads:   make(map[string]*tokenBucket),
+		writes:  make(map[string]*tokenBucket),
+		clients: make(map[string]*tokenBucket),
+	}
+	if conf.Global > 0 {
+		rl.global = newTokenBucket(conf.Global)
+	}
+	if conf.Client > 0 {
+		rl.overflow = newTokenBucket(conf.Client)
+	}
+	for p, rate := range conf.Paths {
+		if rate > 0 {
+			rl.paths[p] = newTokenBucket(rate)
+		}
+	}
+	for class, rate := range conf.Ops {
+		if rate > 0 {
+			rl.ops[class] = newTokenBucket(rate)
+		}
+	}
+	for ns, nl := range conf.Namespaces {
+		if nl.Read > 0 {
+			rl.reads[ns] = newTokenBucket(nl.Read)
+		}
+		if nl.Write > 0 {
+			rl.writes[ns] = newTokenBucket(nl.Write)
+		}
+	}
+	return rl
+}
+
+func (rl *rateLimits) client(ipaddr string, now time.Time) *tokenBucket {
+	rate, ok := rl.conf.Clients[ipaddr]
+	if !ok {
+		rate = rl.conf.Client
+	}
+	if rate <= 0 {
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.pruned) >= limitIdle || len(rl.clients) >= limitMaxIdle && now.Sub(rl.pruned) >= time.Second {
+		for ip, cb := range rl.clients {
+			if cb.idle(now, limitIdle) {
+				delete(rl.clients, ip)
+			}
+		}
+		rl.pruned = now
+	}
+	b, ok := rl.clients[ipaddr]
+	if ok {
+		return b
+	}
+	if _, own := rl.conf.Clients[ipaddr]; !own && len(rl.clients) >= limitMaxIdle {
+		return rl.overflow
+	}
+	b = newTokenBucket(rate)
+	rl.clients[ipaddr] = b
+	return b
+}
+
+// pathUnder reports whether path is prefix or one of its descendants.
+func pathUnder(path, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (rl *rateLimits) path(path string) *tokenBucket {
+	prefix := ""
+	for p := range rl.paths {
+		if len(p) > len(prefix) && pathUnder(path, p) {
+			prefix = p
+		}
+	}
+	return rl.paths[prefix]
+}
+
+// namespace returns the configured namespace path falls under, or "".
+func (rl *rateLimits) namespace(path string) string {
+	ns := ""
+	for p := range rl.conf.Namespaces {
+		if len(p) > len(ns) && pathUnder(path, p) {
+			ns = p
+		}
+	}
+	return ns
+}
+
+// buckets returns every bucket a request is charged to, from the widest to
+// the narrowest.
+func (rl *rateLimits) buckets(ipaddr string, class string, path string, now time.Time) []*tokenBucket {
+	nsBuckets := rl.reads
+	if class == "write" {
+		nsBuckets = rl.writes
+	}
+	bs := make([]*tokenBucket, 0, 5)
+	for _, b := range []*tokenBucket{rl.global, rl.client(ipaddr, now), rl.path(path), nsBuckets[rl.namespace(path)], rl.ops[class]} {
+		if b != nil {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// opClass groups the ops sharing a rate. Session upkeep such as pings has no
+// class and is never limited, as delaying it would expire the session.
+func opClass(op Op) string {
+	switch op {
+	case opCreate, opDelete, opSetData, opSetAcl:
+		return "write"
+	case opExists, opGetData, opGetAcl, opGetChildren, opGetChildren2, opSync, opCheck:
+		return "read"
+	}
+	return ""
+}
+
+// limitCharge is what one op of a request is charged to. Op is the index of
+// the op in a multi.
+type limitCharge struct {
+	op    int
+	class string
+	path  string
+}
+
+// limitCharges lists the charges of a request. Every op of a multi is
+// charged on its own, as if it was sent alone.
+func limitCharges(req interface{}) []limitCharge {
+	multi, ok := req.(*MultiRequest)
+	if !ok {
+		return []limitCharge{{class: opClass(req2op(req)), path: requestPath(req)}}
+	}
+	charges := make([]limitCharge, 0, len(multi.Ops))
+	for i, op := range multi.Ops {
+		charges = append(charges, limitCharge{op: i, class: opClass(op.Header.Type), path: requestPath(op.Op)})
+	}
+	return charges
+}
+
+func currentLimits() *rateLimits {
+	limitMu.Lock()
+	defer limitMu.Unlock()
+	return limits
+}
+
+// checkLimit charges the ops of a request of the client to their buckets. It
+// waits until the request may be served, or returns the error code to answer
+// it with in reject mode or past the wait cap, along with the index in charges
+// of the op refused. Nothing is charged for a refused request.
+func checkLimit(ipaddr string, charges []limitCharge) (ErrCode, int) {
+	rl := currentLimits()
+	if rl == nil {
+		return errOk, 0
+	}
+	now := time.Now()
+	var bs []*tokenBucket
+	var owner []int
+	for i, c := range charges {
+		if c.class == "" {
+			continue
+		}
+		for _, b := range rl.buckets(ipaddr, c.class, c.path, now) {
+			bs = append(bs, b)
+			owner = append(owner, i)
+		}
+	}
+	if rl.conf.Reject {
+		for i, b := range bs {
+			if !b.take(now) {
+				for _, taken := range bs[:i] {
+					taken.refund()
+				}
+				recordLimitReject(charges[owner[i]].path, ipaddr)
+				return rl.conf.RejectCode, owner[i]
+			}
+		}
+		return errOk, 0
+	}
+	var wait time.Duration
+	longest := 0
+	for i, b := range bs {
+		if d := b.reserve(now); d > wait {
+			wait, longest = d, i
+		}
+	}
+	if wait > time.Duration(rl.conf.MaxWait)*time.Millisecond {
+		for _, b := range bs {
+			b.refund()
+		}
+		recordLimitReject(charges[owner[longest]].path, ipaddr)
+		return rl.conf.RejectCode, owner[longest]
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return errOk, 0
+}
+
+// rebuildLimits applies changed flag defaults to the limits in use.
+func rebuildLimits() {
+	limitMu.Lock()
+	defer limitMu.Unlock()
+	conf := LimitConfig{}
+	if limits != nil {
+		conf = limits.conf
+	}
+	limits = newRateLimits(conf)
+}
+
+// SetLimit sets the global request rate.
+func SetLimit(num int) {
+	limitGlobal = num
+	rebuildLimits()
+	glog.V(1).Infof("set request rate limit for %d", num)
+}
+
+// SetLimitReject answers the requests over the limit with code instead of
+// making them wait.
+func SetLimitReject(code int) {
+	limitReject = ErrCode(code)
+	rebuildLimits()
+	glog.V(1).Infof("set request rate limit reject code %d", code)
+}
+
+// InitLimit loads the rate limits from path, see ReloadLimit.
+func InitLimit(path string) error {
+	limitFile = path
+	return ReloadLimit()
+}
+
+// ReloadLimit validates the limit file and swaps it in. The limits in use
+// are kept if the file is invalid.
+func ReloadLimit() error {
+	if limitFile == "" {
+		return errNoLimit
+	}
+	data, err := ioutil.ReadFile(limitFile)
+	if err != nil {
+		return err
+	}
+	conf := LimitConfig{}
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+	for p := range conf.Paths {
+		if p != "/" && !isValidAclPath(p) {
+			return errors.New("invalid path " + p)
+		}
+	}
+	if conf.RejectCode > 0 || conf.QuotaCode > 0 {
+		return errors.New("invalid reject code")
+	}
+	if conf.MaxWait < 0 {
+		return errors.New("invalid max wait")
+	}
+	for ns := range conf.Namespaces {
+		if ns != "/" && !isValidAclPath(ns) {
+			return errors.New("invalid namespace " + ns)
+		}
+	}
+	for class := range conf.Ops {
+		if !containsString(limitOpsClass, class) {
+			return errors.New("invalid op class " + class)
+		}
+	}
+	limitMu.Lock()
+	limits = newRateLimits(conf)
+	limitMu.Unlock()
+	glog.V(1).Infof("load limit file %s", limitFile)
+	return nil
+}
+
+// ListLimit returns the rate limits in use.
+func ListLimit() LimitConfig {
+	rl := currentLimits()
+	if rl == nil {
+		return LimitConfig{}
+	}
+	return rl.conf
+}
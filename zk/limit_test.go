@@ -0,0 +1,263 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type step struct {
+		after time.Duration // since the previous step
+		op    string
+		want  interface{}
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		steps []step
+	}{
+		{"burst of one second", 2, []step{
+			{0, "take", true},
+			{0, "take", true},
+			{0, "take", false},
+			{0, "full", false},
+		}},
+		{"refill", 2, []step{
+			{0, "take", true},
+			{0, "take", true},
+			{400 * time.Millisecond, "take", false},
+			{100 * time.Millisecond, "take", true},
+			{10 * time.Second, "full", true},
+			{0, "take", true},
+			{0, "take", true},
+			{0, "take", false},
+		}},
+		{"reserve goes into debt", 10, []step{
+			{0, "reserve", time.Duration(0)},
+			{0, "drain", nil},
+			{0, "reserve", 100 * time.Millisecond},
+			{0, "reserve", 200 * time.Millisecond},
+			{0, "take", false},
+			{300 * time.Millisecond, "take", true},
+		}},
+		{"refund", 1, []step{
+			{0, "take", true},
+			{0, "take", false},
+			{0, "refund", nil},
+			{0, "full", true},
+			{0, "take", true},
+		}},
+	}
+	for _, tt := range tests {
+		b := newTokenBucket(tt.rate)
+		now := time.Now()
+		b.last = now
+		for i, s := range tt.steps {
+			now = now.Add(s.after)
+			var got interface{}
+			switch s.op {
+			case "take":
+				got = b.take(now)
+			case "reserve":
+				got = b.reserve(now)
+			case "full":
+				got = b.full(now)
+			case "refund":
+				b.refund()
+			case "drain":
+				for b.take(now) {
+				}
+			}
+			if s.want != nil && got != s.want {
+				t.Errorf("%s: step %d %s = %v, want %v", tt.name, i, s.op, got, s.want)
+			}
+		}
+	}
+}
+
+func TestCheckLimitMulti(t *testing.T) {
+	limitMu.Lock()
+	saved := limits
+	limits = newRateLimits(LimitConfig{
+		Reject: true,
+		Namespaces: map[string]NamespaceLimit{
+			"/a": {WriteHourly: 1},
+			"/b": {Write: 1},
+		},
+	})
+	limitMu.Unlock()
+	defer func() {
+		limitMu.Lock()
+		limits = saved
+		limitMu.Unlock()
+		quotaMu.Lock()
+		delete(quotaUsage, "/a")
+		quotaMu.Unlock()
+	}()
+	multi := func(paths ...string) *MultiRequest {
+		req := &MultiRequest{}
+		for _, p := range paths {
+			req.Ops = append(req.Ops, MultiRequestOp{Header: MultiHeader{Type: opCreate}, Op: &CreateRequest{Path: p}})
+		}
+		return req
+	}
+	tests := []struct {
+		check  func(string, []limitCharge) (ErrCode, int)
+		req    interface{}
+		code   ErrCode
+		failed int
+	}{
+		// the second write to /b is over its rate, the first one is refunded
+		{checkLimit, multi("/c/x", "/b/x", "/b/y"), errOperationTimeout, 2},
+		{checkLimit, multi("/a/x", "/b/x"), errOk, 0},
+		{checkLimit, &CreateRequest{Path: "/b/z"}, errOperationTimeout, 0},
+		// the second write to /a is over its quota, the first one is refunded
+		{checkWriteQuota, multi("/a/x", "/a/y"), errQuotaExceeded, 1},
+		{checkWriteQuota, multi("/c/x", "/a/x"), errOk, 0},
+		{checkWriteQuota, &CreateRequest{Path: "/a/z"}, errQuotaExceeded, 0},
+		{checkWriteQuota, &GetDataRequest{Path: "/a/z"}, errOk, 0},
+	}
+	for i, tt := range tests {
+		code, failed := tt.check("10.0.0.1", limitCharges(tt.req))
+		if code != tt.code || failed != tt.failed {
+			t.Errorf("request %d: check = %d at %d, want %d at %d", i, code, failed, tt.code, tt.failed)
+		}
+	}
+}
+
+func TestNodeQuota(t *testing.T) {
+	limitMu.Lock()
+	saved := limits
+	limits = newRateLimits(LimitConfig{
+		QuotaCode: errQuotaExceeded,
+		Namespaces: map[string]NamespaceLimit{
+			"/a": {MaxNodes: 3, MaxDataSize: 4},
+		},
+	})
+	limitMu.Unlock()
+	nodeMu.Lock()
+	nodeCounts["/a"] = 2
+	nodeMu.Unlock()
+	defer func() {
+		limitMu.Lock()
+		limits = saved
+		limitMu.Unlock()
+		nodeMu.Lock()
+		delete(nodeCounts, "/a")
+		nodeMu.Unlock()
+	}()
+	multi := func(ops ...interface{}) *MultiRequest {
+		req := &MultiRequest{}
+		for _, op := range ops {
+			req.Ops = append(req.Ops, MultiRequestOp{Header: MultiHeader{Type: req2op(op)}, Op: op})
+		}
+		return req
+	}
+	tests := []struct {
+		req    interface{}
+		code   ErrCode
+		failed int
+	}{
+		{&CreateRequest{Path: "/a/x"}, errOk, 0},
+		{&SetDataRequest{Path: "/a/x", Data: []byte("12345")}, errQuotaExceeded, 0},
+		{multi(&DeleteRequest{Path: "/b/x"}, &CreateRequest{Path: "/a/x"}, &CreateRequest{Path: "/a/y"}), errQuotaExceeded, 1},
+		{multi(&DeleteRequest{Path: "/a/x"}, &CreateRequest{Path: "/a/y"}, &CreateRequest{Path: "/a/z"}), errOk, 0},
+		{multi(&CreateRequest{Path: "/b/x"}, &SetDataRequest{Path: "/a/x", Data: []byte("12345")}), errQuotaExceeded, 1},
+	}
+	for i, tt := range tests {
+		code, failed, _ := checkNodeQuota(tt.req)
+		if code != tt.code || failed != tt.failed {
+			t.Errorf("request %d: checkNodeQuota = %d at %d, want %d at %d", i, code, failed, tt.code, tt.failed)
+		}
+	}
+
+	// counts follow the successful responses only
+	s := &session{nodeWrites: make(map[Xid]nodeWrite)}
+	s.trackNodeWrite(1, nodeWrite{deltas: appendNodeDelta(nil, opCreate, "/a/x")})
+	s.trackNodeWrite(2, nodeWrite{deltas: appendNodeDelta(nil, opCreate, "/a/y")})
+	w := nodeWrite{multi: true}
+	w.deltas = appendNodeDelta(w.deltas, opCreate, "/a/z")
+	w.deltas = appendNodeDelta(w.deltas, opDelete, "/b/x")
+	s.trackNodeWrite(3, w)
+	s.trackNodeWrite(4, w)
+	aborted, _ := generateMultiErrResp(4, 2, 1, errNoNode)
+	s.countNodeWrites(&ResponseHeader{Xid: 1}, nil)
+	s.countNodeWrites(&ResponseHeader{Xid: 2, Err: errNodeExists}, nil)
+	s.countNodeWrites(&ResponseHeader{Xid: 4}, aborted)
+	ok, _ := generateErrResp(3, errOk)
+	ok = append(ok, encodeMultiOk(t, opCreate, opDelete)...)
+	s.countNodeWrites(&ResponseHeader{Xid: 3}, ok)
+	nodeMu.Lock()
+	n := nodeCounts["/a"]
+	nodeMu.Unlock()
+	if n != 4 {
+		t.Errorf("node count %d after the writes, want 4", n)
+	}
+	if len(s.nodeWrites) != 0 {
+		t.Errorf("%d writes still tracked", len(s.nodeWrites))
+	}
+}
+
+func encodeMultiOk(t *testing.T, ops ...Op) []byte {
+	resp := &MultiResponse{DoneHeader: MultiHeader{Type: opError, Done: true, Err: -1}}
+	for _, op := range ops {
+		resp.Ops = append(resp.Ops, MultiResponseOp{Header: MultiHeader{Type: op}, String: "/a/z"})
+	}
+	buf := make([]byte, 256)
+	n, err := encodePacket(buf, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestCheckLimitMaxWait(t *testing.T) {
+	limitMu.Lock()
+	saved := limits
+	limits = newRateLimits(LimitConfig{Global: 10, MaxWait: 50})
+	limitMu.Unlock()
+	defer func() {
+		limitMu.Lock()
+		limits = saved
+		limitMu.Unlock()
+	}()
+	read := limitCharges(&GetDataRequest{Path: "/a"})
+	for i := 0; i < 10; i++ {
+		if code, _ := checkLimit("10.0.0.1", read); code != errOk {
+			t.Fatalf("request %d within the burst rejected with %d", i, code)
+		}
+	}
+	if code, _ := checkLimit("10.0.0.1", read); code != errOperationTimeout {
+		t.Fatalf("request waiting over max_wait got %d, want %d", code, errOperationTimeout)
+	}
+	// the rejected request left no debt behind
+	time.Sleep(100 * time.Millisecond)
+	if code, _ := checkLimit("10.0.0.1", read); code != errOk {
+		t.Fatalf("request after a refill rejected with %d", code)
+	}
+}
+
+func TestClientBucketsIdle(t *testing.T) {
+	savedMax := limitMaxIdle
+	limitMaxIdle = 2
+	defer func() { limitMaxIdle = savedMax }()
+	rl := newRateLimits(LimitConfig{Client: 10, Clients: map[string]int{"10.0.0.9": 5}})
+	now := time.Now()
+	a, b := rl.client("10.0.0.1", now), rl.client("10.0.0.2", now)
+	if a == b || rl.client("10.0.0.1", now) != a {
+		t.Fatal("clients do not have buckets of their own")
+	}
+	if c := rl.client("10.0.0.3", now); c != rl.overflow {
+		t.Fatal("client past the limit did not get the shared bucket")
+	}
+	if c := rl.client("10.0.0.9", now); c == rl.overflow {
+		t.Fatal("client with its own rate got the shared bucket")
+	}
+	now = now.Add(limitIdle + time.Second)
+	if c := rl.client("10.0.0.3", now); c == rl.overflow {
+		t.Fatal("idle buckets not dropped")
+	}
+	if len(rl.clients) != 1 {
+		t.Fatalf("%d client buckets kept, want 1", len(rl.clients))
+	}
+}
@@ -0,0 +1,221 @@
+package zk
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Node counts of the namespaces with max_nodes are rebuilt by a periodic scan
+// and follow the creates and deletes this proxy sees succeed in between. Until
+// the first scan of a namespace its node count is not enforced.
+//
+// A scan lists the children of every node in those namespaces, one request
+// per node, and every proxy of a fleet runs its own. On large namespaces keep
+// quota_scan long; counts between scans drift by the writes of other proxies.
+var (
+	nodeConn         *zk.Conn
+	nodeScanInterval = 1 * time.Minute
+	nodeMu           sync.Mutex
+	nodeCounts       = make(map[string]int64)
+)
+
+// nodeDelta is how a write changes the node count of a namespace.
+type nodeDelta struct {
+	ns string
+	n  int64
+}
+
+// nodeWrite is a forwarded request changing node counts once it succeeds.
+type nodeWrite struct {
+	multi  bool
+	deltas []nodeDelta
+}
+
+// InitNodeQuota starts counting the nodes of the namespaces with max_nodes
+// every interval.
+func InitNodeQuota(servers []string, interval time.Duration) {
+	var err error
+	nodeConn, _, err = zk.Connect(servers, 5*time.Second, zk.WithLogInfo(false))
+	if err != nil {
+		panic(err)
+	}
+	nodeScanInterval = interval
+	go scanNodeQuota()
+	glog.V(1).Infof("set node quota scan interval for %v", interval)
+}
+
+func scanNodeQuota() {
+	t := time.NewTicker(nodeScanInterval)
+	defer t.Stop()
+	for {
+		for ns, nl := range ListLimit().Namespaces {
+			if nl.MaxNodes <= 0 {
+				continue
+			}
+			n, err := countNodes(ns)
+			if err != nil {
+				glog.Errorf("count nodes of %s %v", ns, err)
+				continue
+			}
+			nodeMu.Lock()
+			nodeCounts[ns] = n
+			nodeMu.Unlock()
+		}
+		<-t.C
+	}
+}
+
+// countNodes counts path and all nodes below it.
+func countNodes(path string) (int64, error) {
+	n := int64(0)
+	stack := []string{path}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		children, _, err := nodeConn.Children(p)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+		for _, child := range children {
+			if p == "/" {
+				stack = append(stack, "/"+child)
+			} else {
+				stack = append(stack, p+"/"+child)
+			}
+		}
+	}
+	return n, nil
+}
+
+// checkNodeQuota checks the data size and node count limits of the writes in
+// a request. It returns the error code to answer a violating request with,
+// the index of the op at fault in a multi and why. Counts are only changed
+// by the response, see countNodeWrites.
+func checkNodeQuota(req interface{}) (ErrCode, int, string) {
+	rl := currentLimits()
+	if rl == nil || len(rl.conf.Namespaces) == 0 {
+		return errOk, 0, ""
+	}
+	reqs := []interface{}{req}
+	if multi, ok := req.(*MultiRequest); ok {
+		reqs = reqs[:0]
+		for _, op := range multi.Ops {
+			reqs = append(reqs, op.Op)
+		}
+	}
+	delta := make(map[string]int64)
+	first := make(map[string]int) // first create of each namespace
+	for i, r := range reqs {
+		var data []byte
+		switch r := r.(type) {
+		case *CreateRequest:
+			data = r.Data
+			ns := rl.namespace(r.Path)
+			if _, ok := first[ns]; !ok {
+				first[ns] = i
+			}
+			delta[ns]++
+		case *SetDataRequest:
+			data = r.Data
+		case *DeleteRequest:
+			delta[rl.namespace(r.Path)]--
+			continue
+		default:
+			continue
+		}
+		path := requestPath(r)
+		if nl := rl.conf.Namespaces[rl.namespace(path)]; nl.MaxDataSize > 0 && len(data) > nl.MaxDataSize {
+			return rl.conf.QuotaCode, i, "data size " + strconv.Itoa(len(data)) + " over " + strconv.Itoa(nl.MaxDataSize)
+		}
+	}
+	nodeMu.Lock()
+	defer nodeMu.Unlock()
+	for ns, d := range delta {
+		n, ok := nodeCounts[ns]
+		if !ok || ns == "" {
+			continue
+		}
+		if max := rl.conf.Namespaces[ns].MaxNodes; d > 0 && max > 0 && n+d > max {
+			return rl.conf.QuotaCode, first[ns], "node count " + strconv.FormatInt(n, 10) + " of " + ns + " at max " + strconv.FormatInt(max, 10)
+		}
+	}
+	return errOk, 0, ""
+}
+
+// appendNodeDelta adds the change of a create or delete of path to the
+// counted namespaces.
+func appendNodeDelta(deltas []nodeDelta, op Op, path string) []nodeDelta {
+	if op != opCreate && op != opDelete {
+		return deltas
+	}
+	rl := currentLimits()
+	if rl == nil || len(rl.conf.Namespaces) == 0 {
+		return deltas
+	}
+	ns := rl.namespace(path)
+	nodeMu.Lock()
+	_, ok := nodeCounts[ns]
+	nodeMu.Unlock()
+	if !ok || ns == "" {
+		return deltas
+	}
+	if op == opCreate {
+		return append(deltas, nodeDelta{ns, 1})
+	}
+	return append(deltas, nodeDelta{ns, -1})
+}
+
+// trackNodeWrite remembers the node count changes of request xid until its
+// response tells whether they happened.
+func (s *session) trackNodeWrite(xid Xid, w nodeWrite) {
+	if len(w.deltas) == 0 {
+		return
+	}
+	s.nodeMu.Lock()
+	s.nodeWrites[xid] = w
+	s.nodeMu.Unlock()
+}
+
+// countNodeWrites applies the node count changes of a successful tracked
+// request. A multi only changes anything if none of its ops failed.
+func (s *session) countNodeWrites(hdr *ResponseHeader, raw []byte) {
+	s.nodeMu.Lock()
+	w, ok := s.nodeWrites[hdr.Xid]
+	if ok {
+		delete(s.nodeWrites, hdr.Xid)
+	}
+	s.nodeMu.Unlock()
+	if !ok || hdr.Err != errOk {
+		return
+	}
+	if w.multi {
+		n, err := decodePacket(raw, &ResponseHeader{})
+		if err != nil {
+			return
+		}
+		resp := &MultiResponse{}
+		if _, err = decodePacket(raw[n:], resp); err != nil {
+			return
+		}
+		for _, op := range resp.Ops {
+			if op.Header.Type == opError {
+				return
+			}
+		}
+	}
+	nodeMu.Lock()
+	defer nodeMu.Unlock()
+	for _, d := range w.deltas {
+		if _, ok := nodeCounts[d.ns]; ok {
+			nodeCounts[d.ns] += d.n
+		}
+	}
+}
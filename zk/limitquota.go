@@ -0,0 +1,134 @@
+package zk
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// QuotaUsage is the write quota of one namespace and how much of it the
+// current hour and day have used on this proxy.
+type QuotaUsage struct {
+	Namespace   string    `json:"namespace"`
+	WriteHourly int64     `json:"write_hourly"`
+	HourlyUsed  int64     `json:"hourly_used"`
+	Hour        time.Time `json:"hour"`
+	WriteDaily  int64     `json:"write_daily"`
+	DailyUsed   int64     `json:"daily_used"`
+	Day         time.Time `json:"day"`
+	warned      bool      // quota exhaustion logged in the current windows
+}
+
+// Usage is kept across limit reloads, so changing a quota does not reset it.
+// It lives in memory only: every proxy has its own, lost on restart.
+var (
+	quotaMu    sync.Mutex
+	quotaUsage = make(map[string]*QuotaUsage)
+)
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// roll starts new windows once the hour or day is over.
+func (u *QuotaUsage) roll(now time.Time) {
+	if hour := now.Truncate(time.Hour); !hour.Equal(u.Hour) {
+		u.Hour = hour
+		u.HourlyUsed = 0
+		u.warned = false
+	}
+	if day := startOfDay(now); !day.Equal(u.Day) {
+		u.Day = day
+		u.DailyUsed = 0
+		u.warned = false
+	}
+}
+
+// takeWriteQuota counts a write to ns, unless it would go over its quota.
+func takeWriteQuota(ns string, nl NamespaceLimit, now time.Time) bool {
+	if nl.WriteHourly <= 0 && nl.WriteDaily <= 0 {
+		return true
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	u, ok := quotaUsage[ns]
+	if !ok {
+		u = &QuotaUsage{Namespace: ns}
+		quotaUsage[ns] = u
+	}
+	u.roll(now)
+	u.WriteHourly, u.WriteDaily = nl.WriteHourly, nl.WriteDaily
+	if (nl.WriteHourly > 0 && u.HourlyUsed >= nl.WriteHourly) || (nl.WriteDaily > 0 && u.DailyUsed >= nl.WriteDaily) {
+		if !u.warned {
+			u.warned = true
+			glog.Warningf("write quota of %s used up: hourly %d/%d daily %d/%d", ns, u.HourlyUsed, nl.WriteHourly, u.DailyUsed, nl.WriteDaily)
+		}
+		return false
+	}
+	u.HourlyUsed++
+	u.DailyUsed++
+	return true
+}
+
+// checkWriteQuota charges the writes of a request of the client to the
+// quotas of their namespaces, or returns the quota code and the index in
+// charges of the write refused. Nothing is charged for a refused request.
+func checkWriteQuota(ipaddr string, charges []limitCharge) (ErrCode, int) {
+	rl := currentLimits()
+	if rl == nil {
+		return errOk, 0
+	}
+	now := time.Now()
+	var quotas []string
+	for i, c := range charges {
+		ns := rl.namespace(c.path)
+		if c.class != "write" || ns == "" {
+			continue
+		}
+		if !takeWriteQuota(ns, rl.conf.Namespaces[ns], now) {
+			for _, taken := range quotas {
+				refundWriteQuota(taken)
+			}
+			recordLimitReject(c.path, ipaddr)
+			return rl.conf.QuotaCode, i
+		}
+		quotas = append(quotas, ns)
+	}
+	return errOk, 0
+}
+
+func refundWriteQuota(ns string) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if u, ok := quotaUsage[ns]; ok {
+		u.HourlyUsed--
+		u.DailyUsed--
+	}
+}
+
+// ListQuotaUsage returns the write quota usage of every namespace with a
+// quota.
+func ListQuotaUsage() []QuotaUsage {
+	conf := ListLimit()
+	now := time.Now()
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	usage := []QuotaUsage{}
+	for ns, nl := range conf.Namespaces {
+		if nl.WriteHourly <= 0 && nl.WriteDaily <= 0 {
+			continue
+		}
+		u, ok := quotaUsage[ns]
+		if !ok {
+			u = &QuotaUsage{Namespace: ns}
+		}
+		u.roll(now)
+		u.WriteHourly, u.WriteDaily = nl.WriteHourly, nl.WriteDaily
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Namespace < usage[j].Namespace })
+	return usage
+}
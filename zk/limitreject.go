@@ -0,0 +1,71 @@
+package zk
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LimitReject counts the requests of one client on one path rejected by the
+// rate limit.
+type LimitReject struct {
+	Path  string    `json:"path"`
+	Ip    string    `json:"ip"`
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+type limitRejectKey struct {
+	path string
+	ip   string
+}
+
+var (
+	limitRejectLimit   = 10000
+	limitRejectsMu     sync.Mutex
+	limitRejects       = make(map[limitRejectKey]*LimitReject)
+	limitRejectCount   = expvar.NewInt("limit_rejected")
+	limitRejectDropped = expvar.NewInt("limit_rejected_dropped")
+)
+
+func recordLimitReject(path, ipaddr string) {
+	limitRejectCount.Add(1)
+	key := limitRejectKey{path, ipaddr}
+	limitRejectsMu.Lock()
+	defer limitRejectsMu.Unlock()
+	r, ok := limitRejects[key]
+	if !ok {
+		if len(limitRejects) >= limitRejectLimit {
+			limitRejectDropped.Add(1)
+			return
+		}
+		r = &LimitReject{Path: path, Ip: ipaddr}
+		limitRejects[key] = r
+	}
+	r.Count++
+	r.Last = time.Now()
+}
+
+// ListLimitRejects returns the recorded rejections, most frequent first.
+func ListLimitRejects() []LimitReject {
+	limitRejectsMu.Lock()
+	rejects := make([]LimitReject, 0, len(limitRejects))
+	for _, r := range limitRejects {
+		rejects = append(rejects, *r)
+	}
+	limitRejectsMu.Unlock()
+	sort.Slice(rejects, func(i, j int) bool {
+		if rejects[i].Count != rejects[j].Count {
+			return rejects[i].Count > rejects[j].Count
+		}
+		return rejects[i].Path < rejects[j].Path
+	})
+	return rejects
+}
+
+func ResetLimitRejects() {
+	limitRejectsMu.Lock()
+	limitRejects = make(map[limitRejectKey]*LimitReject)
+	limitRejectsMu.Unlock()
+}
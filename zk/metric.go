@@ -29,6 +29,10 @@ func getNumConnections() interface{} {
 	return activeSessions.Count()
 }
 
+func getAclCacheAge() interface{} {
+	return aclCache.age().Seconds()
+}
+
 func init() {
 	// http.HandleFunc("/debug/vars", GetMetric)
 	expvar.Publish("version", expvar.Func(currentGoVersion))
@@ -37,4 +41,5 @@ func init() {
 	expvar.Publish("cgo", expvar.Func(getNumCgoCall))
 	expvar.Publish("goroutine", expvar.Func(getNumGoroutins))
 	expvar.Publish("connections", expvar.Func(getNumConnections))
+	expvar.Publish("acl_cache_age", expvar.Func(getAclCacheAge))
 }
@@ -1,9 +1,48 @@
 package zk
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // use a map
 
+var opNames = map[Op]string{
+	opCreate:       "Create",
+	opDelete:       "Delete",
+	opExists:       "Exists",
+	opGetData:      "Get",
+	opSetData:      "Set",
+	opGetAcl:       "GetAcl",
+	opSetAcl:       "SetAcl",
+	opGetChildren:  "GetChildren",
+	opSync:         "Sync",
+	opPing:         "Ping",
+	opGetChildren2: "GetChildren2",
+	opCheck:        "Check",
+	opMulti:        "Multi",
+	opClose:        "Close",
+	opSetAuth:      "SetAuth",
+	opSetWatches:   "SetWatches",
+}
+
+// parseOpName is the inverse of opName, ignoring case.
+func parseOpName(name string) (Op, bool) {
+	for op, n := range opNames {
+		if strings.EqualFold(n, name) {
+			return op, true
+		}
+	}
+	return opInvalid, false
+}
+
+func opName(op Op) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
 func op2req(op Op) interface{} {
 	switch op {
 	case opGetChildren2:
@@ -120,3 +159,32 @@ func req2op(req interface{}) Op {
 	}
 	return opInvalid
 }
+
+// requestPath returns the path a request operates on, or "" if it has none.
+func requestPath(req interface{}) string {
+	switch req := req.(type) {
+	case *CreateRequest:
+		return req.Path
+	case *DeleteRequest:
+		return req.Path
+	case *SetDataRequest:
+		return req.Path
+	case *CheckVersionRequest:
+		return req.Path
+	case *GetDataRequest:
+		return req.Path
+	case *ExistsRequest:
+		return req.Path
+	case *GetChildrenRequest:
+		return req.Path
+	case *GetChildren2Request:
+		return req.Path
+	case *GetAclRequest:
+		return req.Path
+	case *SetAclRequest:
+		return req.Path
+	case *SyncRequest:
+		return req.Path
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+package zk
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// The outbox decouples recvLoop from clients which stop reading. Responses
+// for a client are queued up to outboxLimit bytes, and all queues together
+// up to outboxBudget bytes. A client going over its own limit is a slow
+// consumer and handled by slowPolicy. Once the budget is used up, the client
+// with the longest queue is handled the same way, whoever sends next.
+
+// watchXid is the xid of watch events sent by the zk server.
+const watchXid = Xid(-1)
+
+// closeXid is the xid of the close packets the proxy sends on behalf of a
+// client, outside the xids of zookeeper clients so the response is dropped.
+const closeXid = Xid(-16)
+
+const (
+	slowDisconnect = "disconnect" // close the client connection, the session survives
+	slowDropWatch  = "drop_watch" // drop watch events, disconnect if responses do not fit
+	slowExpire     = "expire"     // close the session on the zk server
+)
+
+var (
+	outboxLimit        int64
+	outboxBudget       int64
+	slowPolicy         = slowDisconnect
+	errSlowConsumer    = errors.New("client output buffer full")
+	errOutboxBudget    = errors.New("output buffers of all clients full")
+	outboxBytes        int64 // queued in all outboxes
+	slowConsumerCount  = expvar.NewInt("slow_consumers")
+	droppedWatchEvents = expvar.NewInt("dropped_watch_events")
+)
+
+func init() {
+	expvar.Publish("out_buffered_bytes", expvar.Func(func() interface{} { return atomic.LoadInt64(&outboxBytes) }))
+}
+
+// SetOutputBuffer queues up to limit bytes of responses for each client and
+// budget bytes in total, with policy for clients going over.
+func SetOutputBuffer(limit, budget int64, policy string) error {
+	switch policy {
+	case slowDisconnect, slowDropWatch, slowExpire:
+	default:
+		return errors.New("invalid slow consumer policy " + policy)
+	}
+	outboxLimit, outboxBudget, slowPolicy = limit, budget, policy
+	glog.V(1).Infof("set output buffer %d bytes per client %d in total, slow consumer policy %s", limit, budget, policy)
+	return nil
+}
+
+type outbox struct {
+	conn   Conn
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	bytes  int64
+	closed bool
+}
+
+func newOutbox(conn Conn, done func()) *outbox {
+	o := &outbox{conn: conn}
+	o.cond = sync.NewCond(&o.mu)
+	go o.writeLoop(done)
+	return o
+}
+
+// push queues raw for the client, unless it goes over the limit of the
+// client or, without force, over the budget.
+func (o *outbox) push(raw []byte, force bool) error {
+	n := int64(len(raw))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrClosing
+	}
+	if o.bytes+n > outboxLimit {
+		return errSlowConsumer
+	}
+	if total := atomic.AddInt64(&outboxBytes, n); total > outboxBudget && !force {
+		atomic.AddInt64(&outboxBytes, -n)
+		return errOutboxBudget
+	}
+	o.queue = append(o.queue, raw)
+	o.bytes += n
+	o.cond.Signal()
+	return nil
+}
+
+func (o *outbox) size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.bytes
+}
+
+// writeLoop sends the queued responses, and calls done once the client
+// connection fails.
+func (o *outbox) writeLoop(done func()) {
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return
+		}
+		raw := o.queue[0]
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+
+		_, err := o.conn.Send(raw)
+		o.mu.Lock()
+		// close has given back the bytes still queued, raw included
+		if !o.closed {
+			o.bytes -= int64(len(raw))
+			atomic.AddInt64(&outboxBytes, -int64(len(raw)))
+		}
+		o.mu.Unlock()
+		if err != nil {
+			glog.Errorf("send data to client %v", err)
+			o.close()
+			done()
+			return
+		}
+	}
+}
+
+// close drops the queued responses and stops writeLoop.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	atomic.AddInt64(&outboxBytes, -o.bytes)
+	o.bytes = 0
+	o.queue = nil
+	o.cond.Signal()
+}
+
+// Send queues a response for the client when output buffers are enabled,
+// and applies the slow consumer policy if it does not fit. When the budget is
+// used up the policy goes to the client with the longest queue, and raw is
+// queued in the room that frees.
+func (s *session) Send(raw []byte) (int, error) {
+	if s.out == nil {
+		return s.Conn.Send(raw)
+	}
+	err := s.out.push(raw, false)
+	if err == errOutboxBudget {
+		if victim := longestOutbox(); victim != nil && victim != s {
+			victim.slowConsumer()
+			err = s.out.push(raw, true)
+		}
+	}
+	if err != errSlowConsumer && err != errOutboxBudget {
+		return len(raw), err
+	}
+	if slowPolicy == slowDropWatch && len(raw) >= 4 && Xid(binary.BigEndian.Uint32(raw)) == watchXid {
+		droppedWatchEvents.Add(1)
+		return len(raw), nil
+	}
+	s.slowConsumer()
+	return 0, err
+}
+
+// slowConsumer disconnects the client, and closes its session on the zk
+// server as well with the expire policy.
+func (s *session) slowConsumer() {
+	slowConsumerCount.Add(1)
+	glog.Warningf("slow consumer %s session %s, %s", s.clientAddress, s.sidStr, slowPolicy)
+	if slowPolicy == slowExpire {
+		s.closeServerSession()
+	}
+	s.SClose()
+	// free the budget now rather than once recvLoop is done
+	s.out.close()
+}
+
+// longestOutbox returns the session with the most responses queued.
+func longestOutbox() *session {
+	var longest *session
+	var max int64
+	for item := range activeSessions.IterBuffered() {
+		s, ok := item.Val.(*session)
+		if !ok || s.out == nil {
+			continue
+		}
+		if n := s.out.size(); n > max {
+			longest, max = s, n
+		}
+	}
+	return longest
+}
+
+// closeServerSession asks the zk server to close the session, so it expires
+// right away with its ephemeral nodes.
+func (s *session) closeServerSession() {
+	raw, err := encodeRequest(closeXid, opClose, &CloseRequest{}, 8)
+	if err == nil {
+		_, err = s.zkc.Send(raw)
+	}
+	if err != nil {
+		glog.Errorf("close session %s on zk server %v", s.sidStr, err)
+	}
+}
@@ -0,0 +1,68 @@
+package zk
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// blockedConn is a client connection which never finishes a send.
+type blockedConn struct {
+	recordConn
+	block chan struct{}
+}
+
+func (c *blockedConn) Send(resp []byte) (int, error) {
+	<-c.block
+	return len(resp), nil
+}
+
+func TestOutboxSlowConsumers(t *testing.T) {
+	savedLimit, savedBudget, savedPolicy := outboxLimit, outboxBudget, slowPolicy
+	outboxLimit, outboxBudget, slowPolicy = 10, 16, slowDisconnect
+	block := make(chan struct{})
+	var sessions []*session
+	defer func() {
+		close(block)
+		for _, s := range sessions {
+			s.out.close()
+			activeSessions.Remove(s.sidStr)
+		}
+		outboxLimit, outboxBudget, slowPolicy = savedLimit, savedBudget, savedPolicy
+	}()
+	for _, sid := range []string{"a", "b", "c"} {
+		s := &session{sidStr: "outbox-test-" + sid}
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.out = newOutbox(&blockedConn{block: block}, s.SClose)
+		activeSessions.Set(s.sidStr, s)
+		sessions = append(sessions, s)
+	}
+	a, b, c := sessions[0], sessions[1], sessions[2]
+	// nothing is ever sent, so every byte stays queued
+	steps := []struct {
+		s    *session
+		n    int
+		fail bool
+	}{
+		{a, 8, false},
+		{b, 6, false},
+		{c, 4, false}, // over the budget, a has the longest queue and goes
+		{c, 4, false},
+		{b, 6, true}, // over the limit of b
+	}
+	for i, st := range steps {
+		_, err := st.s.Send(make([]byte, st.n))
+		if (err != nil) != st.fail {
+			t.Fatalf("step %d: send %d bytes to %s %v", i, st.n, st.s.sidStr, err)
+		}
+	}
+	if a.ctx.Err() == nil {
+		t.Error("session with the longest queue was not disconnected")
+	}
+	if b.ctx.Err() == nil {
+		t.Error("session over its limit was not disconnected")
+	}
+	if c.ctx.Err() != nil {
+		t.Error("session under its limit was disconnected")
+	}
+}
@@ -0,0 +1,243 @@
+package zk
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// The scheduler bounds the requests in flight to each zk server and hands
+// its free slots out by weighted fair queuing across the sessions on it. A
+// request waits at most wait ms, 1000 by default, and is answered with
+// reject_code, errOperationTimeout by default, once the wait is over. The
+// weight of a request comes from the first class matching its client ip or
+// path, for example
+//
+//	{
+//	    "capacity": 500,
+//	    "wait": 200,
+//	    "classes": [
+//	        {"name": "critical", "weight": 10, "ips": ["10.1.0.0/16"], "paths": ["/dubbo/core"]},
+//	        {"name": "batch", "weight": 1, "ips": ["10.9.0.0/16"]}
+//	    ]
+//	}
+//
+// Requests matching no class have weight 1. Session upkeep such as pings
+// never waits.
+type schedConfig struct {
+	Capacity   int           `json:"capacity"`
+	Wait       int           `json:"wait"`
+	RejectCode ErrCode       `json:"reject_code"`
+	Classes    []*schedClass `json:"classes"`
+}
+
+type schedClass struct {
+	Name   string   `json:"name"`
+	Weight int      `json:"weight"`
+	Ips    []string `json:"ips"`
+	Paths  []string `json:"paths"`
+	ipnets []*net.IPNet
+}
+
+// schedFlow is the fair queuing state of one session.
+type schedFlow struct {
+	finish float64
+}
+
+type schedWaiter struct {
+	tag   float64
+	seq   uint64
+	index int // in the queue, -1 once handed a slot
+	ready chan struct{}
+}
+
+type schedQueue []*schedWaiter
+
+func (q schedQueue) Len() int { return len(q) }
+func (q schedQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+func (q schedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *schedQueue) Push(x interface{}) {
+	w := x.(*schedWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *schedQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// schedBackend is the queue of one zk server.
+type schedBackend struct {
+	vtime    float64 // finish tag of the last request let through
+	inflight int
+	waiting  schedQueue
+}
+
+type fairScheduler struct {
+	mu       sync.Mutex
+	conf     schedConfig
+	seq      uint64
+	backends map[string]*schedBackend
+}
+
+var (
+	sched         *fairScheduler
+	schedWait     = 1000 // ms, used if the config sets no wait
+	schedRejected = expvar.NewInt("sched_rejected")
+)
+
+// InitScheduler loads the scheduler config from path and starts scheduling
+// the requests forwarded to the zk servers.
+func InitScheduler(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	conf := schedConfig{}
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+	if conf.Capacity <= 0 {
+		return errors.New("invalid capacity")
+	}
+	if conf.Wait < 0 || conf.RejectCode > 0 {
+		return errors.New("invalid wait or reject code")
+	}
+	for _, c := range conf.Classes {
+		if c.Weight <= 0 {
+			return errors.New("invalid weight for class " + c.Name)
+		}
+		for _, ip := range c.Ips {
+			ipnet, err := parseIPNet(ip)
+			if err != nil {
+				return err
+			}
+			c.ipnets = append(c.ipnets, ipnet)
+		}
+	}
+	sched = newFairScheduler(conf)
+	expvar.Publish("scheduler", expvar.Func(func() interface{} { return sched.stats() }))
+	glog.V(1).Infof("load scheduler with capacity %d per server and %d classes from %s", conf.Capacity, len(conf.Classes), path)
+	return nil
+}
+
+func newFairScheduler(conf schedConfig) *fairScheduler {
+	if conf.Wait == 0 {
+		conf.Wait = schedWait
+	}
+	if conf.RejectCode == 0 {
+		conf.RejectCode = errOperationTimeout
+	}
+	return &fairScheduler{conf: conf, backends: make(map[string]*schedBackend)}
+}
+
+// weight returns the weight of a request of ipaddr on path.
+func (fs *fairScheduler) weight(ipaddr, path string) int {
+	ip := net.ParseIP(ipaddr)
+	for _, c := range fs.conf.Classes {
+		for _, ipnet := range c.ipnets {
+			if ip != nil && ipnet.Contains(ip) {
+				return c.Weight
+			}
+		}
+		for _, p := range c.Paths {
+			if path != "" && pathUnder(path, p) {
+				return c.Weight
+			}
+		}
+	}
+	return 1
+}
+
+// acquire blocks until the request of flow may go to backend, and reports
+// false if it may not because ctx is done or the wait is over. Each request
+// advances the flow by 1/weight of virtual time, and the waiting request with
+// the earliest finish tag gets the next free slot of the backend.
+func (fs *fairScheduler) acquire(ctx context.Context, flow *schedFlow, backend string, weight int) bool {
+	fs.mu.Lock()
+	b, ok := fs.backends[backend]
+	if !ok {
+		b = &schedBackend{}
+		fs.backends[backend] = b
+	}
+	start := flow.finish
+	if b.vtime > start {
+		start = b.vtime
+	}
+	flow.finish = start + 1/float64(weight)
+	if b.inflight < fs.conf.Capacity && len(b.waiting) == 0 {
+		b.inflight++
+		b.vtime = flow.finish
+		fs.mu.Unlock()
+		return true
+	}
+	fs.seq++
+	w := &schedWaiter{tag: flow.finish, seq: fs.seq, ready: make(chan struct{})}
+	heap.Push(&b.waiting, w)
+	fs.mu.Unlock()
+
+	t := time.NewTimer(time.Duration(fs.conf.Wait) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+	case <-t.C:
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if w.index < 0 {
+		// handed a slot meanwhile
+		return true
+	}
+	heap.Remove(&b.waiting, w.index)
+	schedRejected.Add(1)
+	return false
+}
+
+// release frees the slot of a request to backend which got its response, or
+// hands it to the next request waiting for it.
+func (fs *fairScheduler) release(backend string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	b, ok := fs.backends[backend]
+	if !ok {
+		return
+	}
+	if len(b.waiting) == 0 {
+		b.inflight--
+		return
+	}
+	w := heap.Pop(&b.waiting).(*schedWaiter)
+	b.vtime = w.tag
+	close(w.ready)
+}
+
+func (fs *fairScheduler) stats() map[string]map[string]int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	stats := make(map[string]map[string]int, len(fs.backends))
+	for backend, b := range fs.backends {
+		stats[backend] = map[string]int{"inflight": b.inflight, "waiting": len(b.waiting), "capacity": fs.conf.Capacity}
+	}
+	return stats
+}
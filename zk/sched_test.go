@@ -0,0 +1,111 @@
+package zk
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSchedulerWeightedOrder(t *testing.T) {
+	type req struct {
+		flow   int
+		weight int
+	}
+	tests := []struct {
+		name string
+		reqs []req
+		want []int // indexes of reqs in the order they get the slot
+	}{
+		{"one flow keeps its order", []req{{0, 1}, {0, 1}, {0, 1}}, []int{0, 1, 2}},
+		{"heavier flow goes more often", []req{{0, 2}, {0, 2}, {1, 3}, {1, 3}}, []int{2, 0, 3, 1}},
+		{"late heavy flow overtakes", []req{{0, 1}, {0, 1}, {0, 1}, {1, 10}}, []int{3, 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		fs := newFairScheduler(schedConfig{Capacity: 1, Wait: 10000})
+		busy := &schedFlow{}
+		fs.acquire(context.Background(), busy, "a", 100)
+		flows := make([]schedFlow, 2)
+		got := make(chan int, len(tt.reqs))
+		for i, r := range tt.reqs {
+			go func(i int, r req) {
+				if fs.acquire(context.Background(), &flows[r.flow], "a", r.weight) {
+					got <- i
+				}
+			}(i, r)
+			waitQueued(t, fs, "a", i+1)
+		}
+		order := []int{}
+		for range tt.reqs {
+			fs.release("a")
+			select {
+			case i := <-got:
+				order = append(order, i)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: no request got the released slot", tt.name)
+			}
+		}
+		for i := range tt.want {
+			if order[i] != tt.want[i] {
+				t.Errorf("%s: order %v, want %v", tt.name, order, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSchedulerAcquire(t *testing.T) {
+	type step struct {
+		backend  string
+		canceled bool
+		want     bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"backends do not share slots", []step{
+			{"a", false, true},
+			{"b", false, true},
+			{"a", false, false},
+			{"b", false, false},
+		}},
+		{"canceled wait gives up", []step{
+			{"a", false, true},
+			{"a", true, false},
+		}},
+		{"canceled with a free slot", []step{
+			{"a", true, true},
+		}},
+	}
+	for _, tt := range tests {
+		fs := newFairScheduler(schedConfig{Capacity: 1, Wait: 20})
+		for i, s := range tt.steps {
+			ctx, cancel := context.WithCancel(context.Background())
+			if s.canceled {
+				cancel()
+			}
+			got := fs.acquire(ctx, &schedFlow{}, s.backend, 1)
+			cancel()
+			if got != s.want {
+				t.Errorf("%s: step %d acquire on %s = %v, want %v", tt.name, i, s.backend, got, s.want)
+			}
+		}
+		for backend, st := range fs.stats() {
+			if st["waiting"] != 0 {
+				t.Errorf("%s: %d requests left waiting on %s", tt.name, st["waiting"], backend)
+			}
+		}
+	}
+}
+
+// waitQueued waits until n requests wait for backend.
+func waitQueued(t *testing.T, fs *fairScheduler, backend string, n int) {
+	deadline := time.Now().Add(time.Second)
+	for fs.stats()[backend]["waiting"] < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting on %s, want %d", fs.stats()[backend]["waiting"], backend, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
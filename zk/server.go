@@ -2,32 +2,17 @@ package zk
 
 import (
 	"net"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
-	"go.uber.org/ratelimit"
 	"golang.org/x/net/context"
 )
 
-var (
-	isLimit  = false
-	limitNum = 1000 // per second
-)
-
 type acceptHandler func(ctx context.Context, conn net.Conn, auth AuthFunc, zk ZKFunc)
 
-func SetLimit(num int) {
-	isLimit = true
-	limitNum = num
-	glog.V(1).Infof("set request rate limit for %d", limitNum)
-}
-
 func Serve(ctx context.Context, ln net.Listener, auth AuthFunc, zk ZKFunc) {
-	if isLimit {
-		serveByHandler(ctx, handleSessionConcurrentRequests, ln, auth, zk)
-	} else {
-		serveByHandler(ctx, handleSessionSerialRequests, ln, auth, zk)
-	}
+	serveByHandler(ctx, handleSessionSerialRequests, ln, auth, zk)
 }
 
 func handleSessionSerialRequests(ctx context.Context, conn net.Conn, auth AuthFunc, zk ZKFunc) {
@@ -44,28 +29,27 @@ func handleSessionSerialRequests(ctx context.Context, conn net.Conn, auth AuthFu
 	}
 }
 
-func handleSessionConcurrentRequests(ctx context.Context, conn net.Conn, auth AuthFunc, zk ZKFunc) {
-	rl := ratelimit.New(limitNum)
-
-	s, zke, serr := openClientSession(ctx, conn, auth, zk)
-	if serr != nil {
-		return
-	}
-	glog.V(1).Infof("serving concurrent session requests from %s session %s", conn.RemoteAddr(), s.SidStr())
-	for zkreq := range s.Read() {
-		rl.Take()
-		if err := serveRequest(s, zke, zkreq); err != nil {
-			s.SClose()
-			return
-		}
-	}
-}
-
 // receive request from client and send respone to client
 func serveRequest(s Session, zke ZK, zkreq ZKRequest) error {
 	if zkreq.err != nil {
 		return zkreq.err
 	}
+	charges := limitCharges(zkreq.req)
+	if failed := guardedCharge(charges); failed >= 0 {
+		glog.Warningf("%s %s %s %s %s rejected on the session guard records", s.ClientAddress(), s.ServerAddress(), s.SidStr(), opName(req2op(zkreq.req)), charges[failed].path)
+		raw, _ := rejectResp(zkreq.xid, zkreq.req, charges[failed].op, errNoAuth)
+		return replyInOrder(s, zkreq.xid, raw)
+	}
+	if code, failed := checkLimit(strings.Split(s.ClientAddress(), ":")[0], charges); code != errOk {
+		glog.V(1).Infof("%s %s %s %s %s rejected by limit", s.ClientAddress(), s.ServerAddress(), s.SidStr(), opName(req2op(zkreq.req)), charges[failed].path)
+		raw, _ := rejectResp(zkreq.xid, zkreq.req, charges[failed].op, code)
+		return replyInOrder(s, zkreq.xid, raw)
+	}
+	if code, failed, reason := checkNodeQuota(zkreq.req); code != errOk {
+		glog.Warningf("%s %s %s %s %s rejected by quota: %s", s.ClientAddress(), s.ServerAddress(), s.SidStr(), opName(req2op(zkreq.req)), charges[failed].path, reason)
+		raw, _ := rejectResp(zkreq.xid, zkreq.req, failed, code)
+		return replyInOrder(s, zkreq.xid, raw)
+	}
 	st := time.Now()
 	opType, zkPath, respErr := DispatchZK(zke, zkreq.xid, zkreq.req, zkreq.raw)
 	if respErr != nil {
@@ -101,3 +85,24 @@ func serveByHandler(ctx context.Context, h acceptHandler, ln net.Listener, auth
 		}
 	}
 }
+
+// rejectResp answers a request refused by the proxy with errcode. A multi is
+// answered as aborted at its op failed.
+func rejectResp(xid Xid, req interface{}, failed int, errcode ErrCode) ([]byte, error) {
+	if multi, ok := req.(*MultiRequest); ok {
+		return generateMultiErrResp(xid, len(multi.Ops), failed, errcode)
+	}
+	return generateErrResp(xid, errcode)
+}
+
+// replyInOrder answers a request refused by the proxy after the responses
+// to the earlier requests of the session.
+func replyInOrder(s Session, xid Xid, raw []byte) error {
+	if r, ok := s.(interface {
+		reply(xid Xid, raw []byte) error
+	}); ok {
+		return r.reply(xid, raw)
+	}
+	_, err := s.Send(raw)
+	return err
+}
@@ -0,0 +1,40 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRejectAfterEarlierResponses(t *testing.T) {
+	limitMu.Lock()
+	saved := limits
+	limits = newRateLimits(LimitConfig{
+		Reject:     true,
+		Namespaces: map[string]NamespaceLimit{"/a": {Write: 1}},
+	})
+	limitMu.Unlock()
+	defer func() {
+		limitMu.Lock()
+		limits = saved
+		limitMu.Unlock()
+	}()
+	conn, zkc := &recordConn{}, &recordClient{readc: make(chan ZKResponse)}
+	s := newTestSession(t, conn, zkc)
+
+	if err := s.future(1, opGetData, "/a/x", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	checkLimit("10.0.0.1", limitCharges(&CreateRequest{Path: "/a/x"}))
+	if err := serveRequest(s, nil, ZKRequest{xid: 2, req: &CreateRequest{Path: "/a/y"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if xids := conn.xids(); len(xids) != 0 {
+		t.Fatalf("replied %v before the response of 1", xids)
+	}
+	zkc.answer(1)
+	xids := waitSent(t, conn, 2)
+	if len(xids) != 2 || xids[0] != 1 || xids[1] != 2 {
+		t.Fatalf("replied %v, want [1 2]", xids)
+	}
+}
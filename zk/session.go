@@ -2,10 +2,13 @@ package zk
 
 import (
 	"io"
+	"math"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -28,12 +31,42 @@ type session struct {
 	connReq ConnectRequest
 	sid     Sid
 	sidStr  string
+	timeout time.Duration
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	clientAddress string
 	serverAddress string
+	backend       string // the entry of the server list dialed
+
+	filterMu sync.Mutex
+	filters  map[Xid]childrenFilter
+
+	flow      schedFlow
+	pendingMu sync.Mutex
+	pending   map[Xid]pendingReq
+	late      map[Xid]bool   // requests answered with a timeout by the proxy
+	held      map[Xid][]byte // replies of the proxy waiting for earlier responses
+	wake      chan struct{}  // tells recvLoop a reply was held
+
+	out *outbox // responses queued for the client, nil to send directly
+
+	local      chan []byte // responses made by the proxy, sent in order by recvLoop
+	setWatches []bool      // setWatches waiting for a response, true if injected
+	zxid       int64       // highest zxid the client has seen, read atomically
+
+	nodeMu     sync.Mutex
+	nodeWrites map[Xid]nodeWrite // creates and deletes in counted namespaces
+}
+
+// pendingReq is a forwarded request waiting for its response, tracked for
+// the order of the replies, the scheduler and the backend breaker.
+type pendingReq struct {
+	op       Op
+	sent     time.Time
+	deadline time.Time // zero without request timeout
+	slot     bool      // holds a scheduler slot
 }
 
 func (s *session) Sid() Sid                { return s.sid }
@@ -45,7 +78,13 @@ func (s *session) ConnReq() ConnectRequest { return s.connReq }
 func (s *session) SClose() { s.cancel() }
 
 func (s *session) close() {
+	s.cancel()
 	activeSessions.Remove(s.SidStr())
+	releaseSessionOwner(s.sid, s.timeout)
+	s.closePending()
+	if s.out != nil {
+		s.out.close()
+	}
 	s.Conn.Close()
 	s.zkc.Close()
 }
@@ -69,8 +108,21 @@ func newSession(ctx context.Context, servers []string, zka AuthConn) (*session,
 		return nil, aerr
 	}
 
+	clientAddr := strings.Split(zka.RemoteAddress(), ":")[0]
+	if err = admitSession(areq.Req.SessionID != 0); err != nil {
+		glog.Warningf("refuse session %s from %s %v", formatZkId(int64(areq.Req.SessionID)), clientAddr, err)
+		return nil, err
+	}
+	// answer like an expired session, so the client starts a new one
+	if !checkSessionOwner(areq.Req.SessionID, clientAddr) {
+		if zkc, _ := zka.Write(AuthResponse{Resp: &ConnectResponse{Passwd: make([]byte, 16)}}); zkc != nil {
+			zkc.Close()
+		}
+		return nil, ErrSessionHijack
+	}
+
 	resp := ConnectResponse{}
-	zkConn, err := dialZKServer(servers)
+	zkConn, backend, err := dialZKServer(servers)
 	if err != nil {
 		glog.Errorln(err)
 		return nil, err
@@ -88,6 +140,17 @@ func newSession(ctx context.Context, servers []string, zka AuthConn) (*session,
 		zkConn.Close()
 		return nil, err
 	}
+	// authenticate the server connection for the client if configured
+	if resp.TimeOut > 0 {
+		if rule := matchDigestRule(clientAddr); rule != nil {
+			if err = injectAuth(zkConn, rule); err != nil {
+				glog.Errorf("failed to add auth %s for %s on %s %v", rule.Match, clientAddr, zkConn.RemoteAddr(), err)
+				zkConn.Close()
+				return nil, err
+			}
+			glog.V(1).Infof("add auth %s for %s on %s", rule.Match, clientAddr, zkConn.RemoteAddr())
+		}
+	}
 	// proxy response to client
 	zkc, aerr := zka.Write(AuthResponse{Resp: &resp, FourLetterWord: flw})
 	if zkc == nil || aerr != nil {
@@ -104,38 +167,307 @@ func newSession(ctx context.Context, servers []string, zka AuthConn) (*session,
 		connReq: req,
 		sid:     resp.SessionID,
 		sidStr:  formatZkId(int64(resp.SessionID)),
+		timeout: time.Duration(resp.TimeOut) * time.Millisecond,
 		ctx:     sessionCtx,
 		cancel:  cancel,
+		filters: make(map[Xid]childrenFilter),
+		pending: make(map[Xid]pendingReq),
+		late:    make(map[Xid]bool),
+		held:    make(map[Xid][]byte),
+		wake:    make(chan struct{}, 1),
+		local:   make(chan []byte),
+		zxid:    int64(areq.Req.LastZxidSeen),
+
+		nodeWrites: make(map[Xid]nodeWrite),
+	}
+	if outboxLimit > 0 {
+		s.out = newOutbox(s.Conn, s.SClose)
 	}
 	s.clientAddress = s.Conn.RemoteAddress()
 	s.serverAddress = s.zkc.RemoteAddress()
+	s.backend = backend
 
 	activeSessions.Set(s.SidStr(), s)
+	if resp.TimeOut > 0 {
+		registerSessionOwner(s.sid, clientAddr, s.timeout)
+	}
 	go s.recvLoop()
 	return s, nil
 }
 
-func (s *session) future(xid Xid, path string, raw []byte) error {
-	clientAddr := strings.Split(s.clientAddress, ":")[0]
-	if !CheckIpAcl(path, clientAddr) {
-		glog.Warningf("auth failed: client addr: %s path: %s", clientAddr, path)
+func (s *session) future(xid Xid, op Op, path string, raw []byte) error {
+	if !s.allowed(op, path) {
+		raw, _ = generateErrResp(xid, errNoAuth)
+		return s.reply(xid, raw)
+	}
+	if !s.takeQuota(xid, nil, []limitCharge{{class: opClass(op), path: path}}) {
+		return nil
+	}
+	if shouldFilterChildren(op, path) {
+		s.trackChildren(xid, op, path)
+	}
+	s.trackNodeWrite(xid, nodeWrite{deltas: appendNodeDelta(nil, op, path)})
+	return s.forward(xid, op, path, raw)
+}
+
+// futureAcl serves the requests which set a zk acl on path, refusing the
+// acls which break the configured policies.
+func (s *session) futureAcl(xid Xid, op Op, path string, acl []ACL, raw []byte) error {
+	if !s.allowed(op, path) {
 		raw, _ = generateErrResp(xid, errNoAuth)
-		_, err := s.Send(raw)
-		if err != nil {
-			glog.Errorf("send acl err to client for %d %v", int(xid), err)
+		return s.reply(xid, raw)
+	}
+	if reason := checkAclPolicy(path, acl); reason != "" {
+		glog.Warningf("acl policy failed: client addr: %s path: %s op: %s %s", s.clientAddress, path, opName(op), reason)
+		raw, _ = generateErrResp(xid, errInvalidAcl)
+		return s.reply(xid, raw)
+	}
+	if !s.takeQuota(xid, nil, []limitCharge{{class: opClass(op), path: path}}) {
+		return nil
+	}
+	s.trackNodeWrite(xid, nodeWrite{deltas: appendNodeDelta(nil, op, path)})
+	return s.forward(xid, op, path, raw)
+}
+
+// futureMulti checks every op of a multi and aborts the whole transaction
+// if one of them is denied.
+func (s *session) futureMulti(xid Xid, req *MultiRequest, raw []byte) error {
+	for i, op := range req.Ops {
+		path := requestPath(op.Op)
+		if !s.allowed(op.Header.Type, path) {
+			raw, _ = generateMultiErrResp(xid, len(req.Ops), i, errNoAuth)
+			return s.reply(xid, raw)
 		}
+		if create, ok := op.Op.(*CreateRequest); ok {
+			if reason := checkAclPolicy(path, create.Acl); reason != "" {
+				glog.Warningf("acl policy failed: client addr: %s path: %s op: %s %s", s.clientAddress, path, opName(opMulti), reason)
+				raw, _ = generateMultiErrResp(xid, len(req.Ops), i, errInvalidAcl)
+				return s.reply(xid, raw)
+			}
+		}
+	}
+	if !s.takeQuota(xid, req, limitCharges(req)) {
+		return nil
+	}
+	w := nodeWrite{multi: true}
+	for _, op := range req.Ops {
+		w.deltas = appendNodeDelta(w.deltas, op.Header.Type, requestPath(op.Op))
+	}
+	s.trackNodeWrite(xid, w)
+	// the scheduler weighs a multi by the path of its first op
+	path := ""
+	if len(req.Ops) > 0 {
+		path = requestPath(req.Ops[0].Op)
+	}
+	return s.forward(xid, opMulti, path, raw)
+}
+
+// futureSetWatches drops the watches on denied paths before restoring the
+// rest, as the request has no way to report them one by one.
+func (s *session) futureSetWatches(xid Xid, req *SetWatchesRequest, raw []byte) error {
+	allowed := &SetWatchesRequest{
+		RelativeZxid: req.RelativeZxid,
+		DataWatches:  s.allowedWatches(opGetData, req.DataWatches),
+		ExistWatches: s.allowedWatches(opExists, req.ExistWatches),
+		ChildWatches: s.allowedWatches(opGetChildren, req.ChildWatches),
+	}
+	if len(allowed.DataWatches) == len(req.DataWatches) &&
+		len(allowed.ExistWatches) == len(req.ExistWatches) &&
+		len(allowed.ChildWatches) == len(req.ChildWatches) {
+		return s.forward(xid, opSetWatches, "", raw)
+	}
+	raw, err := encodeRequest(xid, opSetWatches, allowed, len(raw))
+	if err != nil {
+		glog.Errorf("encode set watches for %d %v", int(xid), err)
 		return err
 	}
+	return s.forward(xid, opSetWatches, "", raw)
+}
+
+func (s *session) allowedWatches(op Op, paths []string) []string {
+	allowed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if s.allowed(op, path) {
+			allowed = append(allowed, path)
+		}
+	}
+	return allowed
+}
+
+// allowed checks the ip acl for one operation on path. Denials are recorded,
+// and only logged in shadow mode.
+func (s *session) allowed(op Op, path string) bool {
+	clientAddr := strings.Split(s.clientAddress, ":")[0]
+	recordAclLearn(opPermPath(op, path), clientAddr, op)
+	if CheckIpAcl(opPermPath(op, path), clientAddr, opPerm(op)) {
+		return true
+	}
+	recordAclDenial(path, clientAddr, op)
+	if aclShadow {
+		glog.Warningf("shadow auth failed: client addr: %s path: %s op: %s", clientAddr, path, opName(op))
+		return true
+	}
+	glog.Warningf("auth failed: client addr: %s path: %s op: %s", clientAddr, path, opName(op))
+	return false
+}
+
+// takeQuota charges the write quotas of a request once every other check let
+// it through, and answers it if a quota is used up.
+func (s *session) takeQuota(xid Xid, req interface{}, charges []limitCharge) bool {
+	code, failed := checkWriteQuota(strings.Split(s.clientAddress, ":")[0], charges)
+	if code == errOk {
+		return true
+	}
+	glog.Warningf("%s %s %s rejected by write quota", s.clientAddress, s.sidStr, charges[failed].path)
+	raw, _ := rejectResp(xid, req, charges[failed].op, code)
+	s.reply(xid, raw)
+	return false
+}
+
+// reply answers the client without asking the zk server. The client expects
+// its responses in xid order, so the reply is held until every earlier
+// request got its response, and recvLoop sends it in order with them.
+func (s *session) reply(xid Xid, raw []byte) error {
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pendingMu.Unlock()
+		return ErrClosing
+	}
+	s.held[xid] = raw
+	s.pendingMu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// releaseHeld sends the held replies no pending request comes before. It runs
+// on recvLoop.
+func (s *session) releaseHeld() error {
+	s.pendingMu.Lock()
+	if len(s.held) == 0 {
+		s.pendingMu.Unlock()
+		return nil
+	}
+	first := Xid(math.MaxInt32)
+	for xid := range s.pending {
+		if xid < first {
+			first = xid
+		}
+	}
+	xids := make([]Xid, 0, len(s.held))
+	for xid := range s.held {
+		if xid < first {
+			xids = append(xids, xid)
+		}
+	}
+	sort.Slice(xids, func(i, j int) bool { return xids[i] < xids[j] })
+	replies := make([][]byte, len(xids))
+	for i, xid := range xids {
+		replies[i] = s.held[xid]
+		delete(s.held, xid)
+	}
+	s.pendingMu.Unlock()
+	for i, raw := range replies {
+		if _, err := s.Send(raw); err != nil {
+			glog.Errorf("send response to client for %d %v", int(xids[i]), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// forward sends a request to the zk server as is. Every request is tracked
+// until its response, which keeps the replies of the proxy in order. With the
+// scheduler the request first waits for a slot of its server, which is held
+// until its response, and is answered by the proxy if none comes in time;
+// pings and the other requests without a positive xid never wait. With the
+// breaker or request timeout the time to the response is measured. The setWatches of clients come without a path, the ones the
+// proxy injects for shared reads with the path they watch.
+func (s *session) forward(xid Xid, op Op, path string, raw []byte) error {
+	if op == opSetWatches && stormEnabled() {
+		s.trackSetWatches(path != "")
+	}
+	tracked := xid > 0
+	if tracked {
+		req := pendingReq{op: op}
+		if sched != nil {
+			if !sched.acquire(s.ctx, &s.flow, s.backend, sched.weight(strings.Split(s.clientAddress, ":")[0], path)) {
+				glog.Warningf("request %d of %s %s to %s got no scheduler slot", int(xid), s.sidStr, opName(op), s.serverAddress)
+				s.filterMu.Lock()
+				delete(s.filters, xid)
+				s.filterMu.Unlock()
+				s.nodeMu.Lock()
+				delete(s.nodeWrites, xid)
+				s.nodeMu.Unlock()
+				resp, _ := generateErrResp(xid, sched.conf.RejectCode)
+				return s.reply(xid, resp)
+			}
+			req.slot = true
+		}
+		req.sent = time.Now()
+		req.deadline = opDeadline(op, req.sent)
+		s.addPending(xid, req)
+	}
 	_, err := s.zkc.Send(raw)
 	if err != nil {
+		if tracked {
+			s.donePending(xid)
+		}
 		glog.Errorf("send request to zk server for %d %v", int(xid), err)
 	}
 	return err
 }
 
+func (s *session) addPending(xid Xid, req pendingReq) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.pending == nil {
+		// the session is closed and nothing will answer
+		if req.slot {
+			sched.release(s.backend)
+		}
+		return
+	}
+	s.pending[xid] = req
+}
+
+// donePending forgets a request once it got its response, releasing its
+// scheduler slot.
+func (s *session) donePending(xid Xid) (pendingReq, bool) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	req, ok := s.pending[xid]
+	if ok {
+		delete(s.pending, xid)
+		if req.slot {
+			sched.release(s.backend)
+		}
+	}
+	return req, ok
+}
+
+func (s *session) closePending() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for _, req := range s.pending {
+		if req.slot {
+			sched.release(s.backend)
+		}
+	}
+	s.pending = nil
+}
+
 // recvLoop forwards responses from the real zk server to the client connection.
 func (s *session) recvLoop() {
 	defer s.close()
+	var expire <-chan time.Time
+	if timeoutEnabled() {
+		t := time.NewTicker(timeoutCheck)
+		defer t.Stop()
+		expire = t.C
+	}
 	for {
 		select {
 		case resp := <-s.zkc.Read():
@@ -145,11 +477,45 @@ func (s *session) recvLoop() {
 				}
 				return
 			}
-			_, err := s.Send(resp.raw)
+			if resp.hdr.Xid == closeXid {
+				continue
+			}
+			if stormEnabled() && s.stormResponse(resp.hdr, resp.raw) {
+				continue
+			}
+			// a late write still happened
+			s.countNodeWrites(resp.hdr, resp.raw)
+			s.seenZxid(resp.hdr.Zxid)
+			if req, ok := s.donePending(resp.hdr.Xid); ok {
+				observeBackend(s.backend, time.Since(req.sent), isServerError(resp.hdr.Err))
+			} else if s.lateResponse(resp.hdr.Xid) {
+				glog.V(1).Infof("drop late response %d of %s from %s", int(resp.hdr.Xid), s.sidStr, s.serverAddress)
+				continue
+			}
+			_, err := s.Send(s.filterResponse(resp.hdr, resp.raw))
 			if err != nil {
 				glog.Errorf("receloop send data to client %v", err)
 				return
 			}
+			if err = s.releaseHeld(); err != nil {
+				return
+			}
+		case <-s.wake:
+			if err := s.releaseHeld(); err != nil {
+				return
+			}
+		case raw := <-s.local:
+			if _, err := s.Send(raw); err != nil {
+				glog.Errorf("receloop send data to client %v", err)
+				return
+			}
+		case now := <-expire:
+			if err := s.expirePending(now); err != nil {
+				return
+			}
+			if err := s.releaseHeld(); err != nil {
+				return
+			}
 		case <-s.ctx.Done():
 			return
 		}
@@ -176,18 +542,35 @@ func shuffleZkServer(servers []string) {
 	}
 }
 
-func dialZKServer(servers []string) (net.Conn, error) {
-	var conn net.Conn
-	var err error
+// dialZKServer connects to a random server whose breaker is not open, or to
+// any server if there is none.
+func dialZKServer(servers []string) (net.Conn, string, error) {
 	shuffleZkServer(servers)
+	open := []string{}
 	for _, zkServer := range servers {
-		conn, err = net.DialTimeout("tcp", zkServer, time.Duration(500*time.Millisecond))
-		if err == nil {
-			return conn, err
+		if !backendAllowed(zkServer) {
+			open = append(open, zkServer)
+			continue
+		}
+		if conn, err := dialOneZKServer(zkServer); err == nil {
+			return conn, zkServer, nil
 		}
+	}
+	for _, zkServer := range open {
+		if conn, err := dialOneZKServer(zkServer); err == nil {
+			return conn, zkServer, nil
+		}
+	}
+	return nil, "", ErrNoServer
+}
+
+func dialOneZKServer(zkServer string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", zkServer, time.Duration(500*time.Millisecond))
+	if err != nil {
 		glog.V(3).Infof("connect %s err %s", zkServer, err)
+		observeBackend(zkServer, 0, true)
 	}
-	return nil, ErrNoServer
+	return conn, err
 }
 
 func formatZkId(id int64) string {
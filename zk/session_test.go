@@ -0,0 +1,136 @@
+package zk
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// recordClient is a zk server connection keeping the requests sent to it
+// and answering with what the test feeds to readc.
+type recordClient struct {
+	recordConn
+	readc  chan ZKResponse
+	onSend func(raw []byte) // called with every request sent
+}
+
+func (c *recordClient) Send(raw []byte) (int, error) {
+	if c.onSend != nil {
+		c.onSend(raw)
+	}
+	return c.recordConn.Send(raw)
+}
+
+func (c *recordClient) Read() <-chan ZKResponse { return c.readc }
+
+// answer feeds an empty response to xid.
+func (c *recordClient) answer(xid Xid) {
+	raw, _ := generateErrResp(xid, errOk)
+	c.readc <- ZKResponse{hdr: &ResponseHeader{Xid: xid}, raw: raw}
+}
+
+// newTestSession returns a session between conn and zkc whose recvLoop runs
+// until the test ends.
+func newTestSession(t *testing.T, conn *recordConn, zkc *recordClient) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &session{
+		Conn:          conn,
+		zkc:           zkc,
+		ctx:           ctx,
+		cancel:        cancel,
+		clientAddress: conn.RemoteAddress(),
+		filters:       make(map[Xid]childrenFilter),
+		pending:       make(map[Xid]pendingReq),
+		late:          make(map[Xid]bool),
+		held:          make(map[Xid][]byte),
+		wake:          make(chan struct{}, 1),
+		local:         make(chan []byte),
+		nodeWrites:    make(map[Xid]nodeWrite),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.recvLoop()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s
+}
+
+// waitSent waits until conn got n packets and returns their xids.
+func waitSent(t *testing.T, conn *recordConn, n int) []Xid {
+	deadline := time.Now().Add(time.Second)
+	for {
+		xids := conn.xids()
+		if len(xids) >= n || time.Now().After(deadline) {
+			return xids
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplyAfterEarlierResponses(t *testing.T) {
+	withAclCache(t, map[string]*aclEntry{
+		"/closed": {Ips: map[string]aclPerms{}},
+	})
+	conn, zkc := &recordConn{}, &recordClient{readc: make(chan ZKResponse)}
+	s := newTestSession(t, conn, zkc)
+
+	if err := s.future(1, opGetData, "/open/a", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.future(2, opGetData, "/closed/a", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.futureAcl(3, opSetAcl, "/closed/a", nil, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if xids := conn.xids(); len(xids) != 0 {
+		t.Fatalf("replied %v before the response of 1", xids)
+	}
+	zkc.answer(1)
+	xids := waitSent(t, conn, 3)
+	want := []Xid{1, 2, 3}
+	if len(xids) != len(want) {
+		t.Fatalf("replied %v, want %v", xids, want)
+	}
+	for i := range want {
+		if xids[i] != want[i] {
+			t.Fatalf("replied %v, want %v", xids, want)
+		}
+	}
+}
+
+func TestQuotaAfterAcl(t *testing.T) {
+	withAclCache(t, map[string]*aclEntry{
+		"/a/closed": {Ips: map[string]aclPerms{}},
+	})
+	limitMu.Lock()
+	saved := limits
+	limits = newRateLimits(LimitConfig{Namespaces: map[string]NamespaceLimit{"/a": {WriteHourly: 1}}})
+	limitMu.Unlock()
+	defer func() {
+		limitMu.Lock()
+		limits = saved
+		limitMu.Unlock()
+		quotaMu.Lock()
+		delete(quotaUsage, "/a")
+		quotaMu.Unlock()
+	}()
+	conn, zkc := &recordConn{}, &recordClient{readc: make(chan ZKResponse)}
+	s := newTestSession(t, conn, zkc)
+
+	if err := s.future(1, opCreate, "/a/closed/x", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(zkc.xids()) != 0 {
+		t.Fatal("denied create forwarded")
+	}
+	if code, _ := checkWriteQuota("10.0.0.1", limitCharges(&CreateRequest{Path: "/a/x"})); code != errOk {
+		t.Fatalf("denied create used up the quota, got %d", code)
+	}
+}
@@ -0,0 +1,254 @@
+package zk
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// The session guard remembers the client ip which created each zk session in
+// a persistent node under sessionRoot, shared by every proxy of the fleet.
+// The record names the proxy serving the session, which keeps an ephemeral
+// node under proxyRoot while it is up. Once the session leaves its proxy,
+// because the client went away or the proxy died, the record expires after
+// the session timeout, and a sweeper on every proxy deletes the expired
+// records. Until then a reconnect from another ip is caught on any proxy.
+// Clients never get to the records themselves, whatever the ip acl.
+var (
+	guardConn       *zk.Conn
+	guardReject     = false
+	guardID         string
+	guardSweep      = 1 * time.Minute
+	sessionRoot     = permRoot + "/.sessions"
+	proxyRoot       = permRoot + "/.proxies"
+	sessionMoved    = expvar.NewInt("session_ip_changed")
+	sessionRejected = expvar.NewInt("session_hijack_rejected")
+	sessionExpired  = expvar.NewInt("session_owner_expired")
+)
+
+type sessionOwner struct {
+	Ip      string    `json:"ip"`
+	Created time.Time `json:"created"`
+	Proxy   string    `json:"proxy"`
+	Timeout int64     `json:"timeout"`           // of the session in ms
+	Expires int64     `json:"expires,omitempty"` // unix ms, 0 while a proxy serves the session
+}
+
+func (o *sessionOwner) expired(now time.Time) bool {
+	return o.Expires > 0 && now.UnixNano()/int64(time.Millisecond) >= o.Expires
+}
+
+// InitSessionGuard enables the session registry. Reconnects of a session from
+// another ip are logged, and refused as well if reject is set.
+func InitSessionGuard(servers []string, reject bool) {
+	var err error
+	guardConn, _, err = zk.Connect(servers, 5*time.Second, zk.WithLogInfo(false))
+	if err != nil {
+		panic(err)
+	}
+	for _, p := range []string{permRoot, sessionRoot, proxyRoot} {
+		_, err = guardConn.Create(p, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			panic(err)
+		}
+	}
+	host, _ := os.Hostname()
+	guardID = host + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+	if err = registerProxy(); err != nil {
+		panic(err)
+	}
+	guardReject = reject
+	go func() {
+		for range time.Tick(guardSweep) {
+			sweepSessionOwners()
+		}
+	}()
+	glog.V(1).Infof("set session guard as %s, reject reconnect from other ip: %v", guardID, reject)
+}
+
+// registerProxy creates the node telling the other proxies this one is up,
+// which vanishes with the zk session of guardConn.
+func registerProxy() error {
+	_, err := guardConn.Create(proxyRoot+"/"+guardID, []byte{}, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
+
+func sessionOwnerPath(sid Sid) string {
+	return sessionRoot + "/" + formatZkId(int64(sid))
+}
+
+// guardedCharge returns the index of the first charge on the records of the
+// session guard, or -1.
+func guardedCharge(charges []limitCharge) int {
+	for i, c := range charges {
+		if pathUnder(c.path, sessionRoot) {
+			return i
+		}
+	}
+	return -1
+}
+
+func getSessionOwner(sid Sid) (*sessionOwner, *zk.Stat, error) {
+	data, stat, err := guardConn.Get(sessionOwnerPath(sid))
+	if err != nil {
+		return nil, nil, err
+	}
+	owner := &sessionOwner{}
+	if err = json.Unmarshal(data, owner); err != nil {
+		return nil, nil, err
+	}
+	return owner, stat, nil
+}
+
+// checkSessionOwner reports whether ipaddr may reconnect to session sid.
+func checkSessionOwner(sid Sid, ipaddr string) bool {
+	if guardConn == nil || sid == 0 {
+		return true
+	}
+	owner, _, err := getSessionOwner(sid)
+	if err != nil {
+		if err != zk.ErrNoNode {
+			glog.Errorf("get owner of session %s %v", formatZkId(int64(sid)), err)
+		}
+		return true
+	}
+	if owner.Ip == ipaddr || owner.expired(time.Now()) {
+		return true
+	}
+	sessionMoved.Add(1)
+	if !guardReject {
+		glog.Warningf("session %s created by %s reconnect from %s", formatZkId(int64(sid)), owner.Ip, ipaddr)
+		return true
+	}
+	sessionRejected.Add(1)
+	glog.Warningf("reject session %s created by %s reconnect from %s", formatZkId(int64(sid)), owner.Ip, ipaddr)
+	return false
+}
+
+// registerSessionOwner records ipaddr as the creator of session sid unless it
+// is known already, and takes the record over from the proxy which served the
+// session before.
+func registerSessionOwner(sid Sid, ipaddr string, timeout time.Duration) {
+	if guardConn == nil {
+		return
+	}
+	p := sessionOwnerPath(sid)
+	owner, stat, err := getSessionOwner(sid)
+	switch {
+	case err == zk.ErrNoNode:
+		owner = &sessionOwner{Ip: ipaddr, Created: time.Now()}
+	case err != nil:
+		glog.Errorf("get owner of session %s %v", formatZkId(int64(sid)), err)
+		return
+	case owner.expired(time.Now()):
+		owner = &sessionOwner{Ip: ipaddr, Created: time.Now()}
+	case owner.Proxy == guardID && owner.Expires == 0:
+		return
+	}
+	owner.Proxy, owner.Expires = guardID, 0
+	owner.Timeout = int64(timeout / time.Millisecond)
+	data, _ := json.Marshal(owner)
+	if stat == nil {
+		_, err = guardConn.Create(p, data, 0, zk.WorldACL(zk.PermAll))
+	} else {
+		_, err = guardConn.Set(p, data, stat.Version)
+	}
+	if err != nil {
+		glog.Errorf("register owner of session %s %v", formatZkId(int64(sid)), err)
+	}
+}
+
+// releaseSessionOwner starts the expiry of the record of session sid, unless
+// its client came back to this proxy or went to another one.
+func releaseSessionOwner(sid Sid, timeout time.Duration) {
+	if guardConn == nil {
+		return
+	}
+	go func() {
+		if _, ok := activeSessions.Get(formatZkId(int64(sid))); ok {
+			return
+		}
+		owner, stat, err := getSessionOwner(sid)
+		if err != nil || owner.Proxy != guardID || owner.Expires != 0 {
+			return
+		}
+		owner.Expires = expireOwnerAt(time.Now(), timeout)
+		data, _ := json.Marshal(owner)
+		guardConn.Set(sessionOwnerPath(sid), data, stat.Version)
+	}()
+}
+
+func expireOwnerAt(now time.Time, timeout time.Duration) int64 {
+	return now.Add(timeout).UnixNano() / int64(time.Millisecond)
+}
+
+const (
+	ownerKeep = iota
+	ownerExpire
+	ownerDelete
+)
+
+// sweepOwner decides what happens to a record given the proxies up.
+func sweepOwner(owner *sessionOwner, live map[string]bool, now time.Time) int {
+	switch {
+	case owner.expired(now):
+		return ownerDelete
+	case owner.Expires == 0 && !live[owner.Proxy]:
+		return ownerExpire
+	}
+	return ownerKeep
+}
+
+// sweepSessionOwners expires the records of the sessions of proxies which are
+// gone and deletes the expired records. Every proxy sweeps, the versions keep
+// them from undoing each other.
+func sweepSessionOwners() {
+	if err := registerProxy(); err != nil {
+		glog.Errorf("register proxy %s %v", guardID, err)
+	}
+	proxies, _, err := guardConn.Children(proxyRoot)
+	if err != nil {
+		glog.Errorf("list proxies %v", err)
+		return
+	}
+	live := make(map[string]bool, len(proxies))
+	for _, p := range proxies {
+		live[p] = true
+	}
+	children, _, err := guardConn.Children(sessionRoot)
+	if err != nil {
+		glog.Errorf("list session owners %v", err)
+		return
+	}
+	now := time.Now()
+	for _, child := range children {
+		p := sessionRoot + "/" + child
+		data, stat, err := guardConn.Get(p)
+		if err != nil {
+			continue
+		}
+		owner := &sessionOwner{}
+		if err = json.Unmarshal(data, owner); err != nil {
+			glog.Errorf("decode owner of session %s %v", child, err)
+			continue
+		}
+		switch sweepOwner(owner, live, now) {
+		case ownerDelete:
+			if guardConn.Delete(p, stat.Version) == nil {
+				sessionExpired.Add(1)
+			}
+		case ownerExpire:
+			owner.Expires = expireOwnerAt(now, time.Duration(owner.Timeout)*time.Millisecond)
+			data, _ = json.Marshal(owner)
+			guardConn.Set(p, data, stat.Version)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepOwner(t *testing.T) {
+	now := time.Now()
+	ms := func(d time.Duration) int64 { return now.Add(d).UnixNano() / int64(time.Millisecond) }
+	live := map[string]bool{"proxy-a": true}
+	tests := []struct {
+		name  string
+		owner sessionOwner
+		want  int
+	}{
+		{"served by a live proxy", sessionOwner{Proxy: "proxy-a"}, ownerKeep},
+		{"served by a dead proxy", sessionOwner{Proxy: "proxy-b"}, ownerExpire},
+		{"expiring", sessionOwner{Proxy: "proxy-b", Expires: ms(time.Second)}, ownerKeep},
+		{"expired", sessionOwner{Proxy: "proxy-a", Expires: ms(-time.Second)}, ownerDelete},
+	}
+	for _, tt := range tests {
+		if got := sweepOwner(&tt.owner, live, now); got != tt.want {
+			t.Errorf("%s: sweepOwner = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGuardedCharge(t *testing.T) {
+	multi := &MultiRequest{Ops: []MultiRequestOp{
+		{Header: MultiHeader{Type: opCreate}, Op: &CreateRequest{Path: "/ns/a"}},
+		{Header: MultiHeader{Type: opDelete}, Op: &DeleteRequest{Path: sessionRoot + "/0x1"}},
+	}}
+	tests := []struct {
+		req  interface{}
+		want int
+	}{
+		{&GetDataRequest{Path: sessionRoot + "/0x1"}, 0},
+		{&GetChildrenRequest{Path: sessionRoot}, 0},
+		{&GetDataRequest{Path: sessionRoot + "x"}, -1},
+		{&GetChildrenRequest{Path: permRoot}, -1},
+		{multi, 1},
+	}
+	for i, tt := range tests {
+		if got := guardedCharge(limitCharges(tt.req)); got != tt.want {
+			t.Errorf("request %d: guardedCharge = %d, want %d", i, got, tt.want)
+		}
+	}
+}
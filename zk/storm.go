@@ -0,0 +1,309 @@
+package zk
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// setWatchesXid is the xid zookeeper clients use for setWatches packets.
+const setWatchesXid = Xid(-8)
+
+// A path whose watch events reach stormThreshold per second across all
+// sessions is hot for stormHold. Reads of a hot path with getData and
+// getChildren are served from one read on stormConn, shared for stormShare
+// by every session asking. A session asking for a watch gets it registered
+// on its own server by a setWatches relative to the zxid of the shared
+// read, so any change after that read still fires its watch. The shared
+// read may come from a server ahead of the session's own, but never from one
+// behind what the session has seen: a read older than the highest zxid of
+// the session is not shared with it, nor one taking over stormReadTimeout.
+var (
+	stormConn        *zk.Conn
+	stormThreshold   int
+	stormHold        time.Duration
+	stormShare       time.Duration
+	stormWindow      = 1 * time.Second
+	stormReadTimeout = 1 * time.Second // unless the op has a request timeout
+
+	stormMu    sync.Mutex
+	stormStart time.Time
+	stormCount = make(map[string]int)
+	stormHot   = make(map[string]time.Time)
+	stormReads = make(map[stormKey]*stormRead)
+
+	stormShared    = expvar.NewInt("storm_shared_reads")
+	stormBackend   = expvar.NewInt("storm_backend_reads")
+	stormStale     = expvar.NewInt("storm_stale_reads")
+	stormHotEvents = expvar.NewInt("storm_hot_paths")
+)
+
+type stormKey struct {
+	children bool
+	path     string
+}
+
+// stormRead is one read of a hot path, done once in flight.
+type stormRead struct {
+	done     chan struct{}
+	at       time.Time
+	data     []byte
+	children []string
+	stat     Stat
+	err      error
+}
+
+// InitStormDampening shares the reads of paths with threshold watch events
+// per second for hold, each read being reused for share.
+func InitStormDampening(servers []string, threshold int, hold, share time.Duration) {
+	var err error
+	stormConn, _, err = zk.Connect(servers, 5*time.Second, zk.WithLogInfo(false))
+	if err != nil {
+		panic(err)
+	}
+	stormThreshold, stormHold, stormShare = threshold, hold, share
+	glog.V(1).Infof("set watch storm threshold %d hold %v share %v", threshold, hold, share)
+}
+
+func stormEnabled() bool {
+	return stormThreshold > 0
+}
+
+// recordWatchEvent counts a watch event sent to a client on path.
+func recordWatchEvent(path string) {
+	now := time.Now()
+	stormMu.Lock()
+	defer stormMu.Unlock()
+	if now.Sub(stormStart) >= stormWindow {
+		stormStart = now
+		stormCount = make(map[string]int)
+		for p, until := range stormHot {
+			if now.After(until) {
+				delete(stormHot, p)
+			}
+		}
+		for key, r := range stormReads {
+			if !r.at.IsZero() && now.Sub(r.at) >= stormShare {
+				delete(stormReads, key)
+			}
+		}
+	}
+	stormCount[path]++
+	if stormCount[path] < stormThreshold {
+		return
+	}
+	if _, ok := stormHot[path]; !ok {
+		stormHotEvents.Add(1)
+		glog.Warningf("watch storm on %s, share reads for %v", path, stormHold)
+	}
+	stormHot[path] = now.Add(stormHold)
+}
+
+func isStormHot(path string) bool {
+	if !stormEnabled() {
+		return false
+	}
+	stormMu.Lock()
+	defer stormMu.Unlock()
+	until, ok := stormHot[path]
+	return ok && time.Now().Before(until)
+}
+
+// sharedRead returns a recent read of path, or reads it once for every
+// session asking at the same time. It returns nil if the read does not come
+// within timeout.
+func sharedRead(children bool, path string, timeout time.Duration) *stormRead {
+	key := stormKey{children, path}
+	stormMu.Lock()
+	r, ok := stormReads[key]
+	if ok && (r.at.IsZero() || time.Since(r.at) < stormShare) {
+		stormMu.Unlock()
+		stormShared.Add(1)
+	} else {
+		r = &stormRead{done: make(chan struct{})}
+		stormReads[key] = r
+		stormMu.Unlock()
+		stormBackend.Add(1)
+		go r.read(children, path)
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-r.done:
+		return r
+	case <-t.C:
+		return nil
+	}
+}
+
+// read reads path on stormConn, feeding the breaker of the server it asked.
+func (r *stormRead) read(children bool, path string) {
+	st := time.Now()
+	var stat *zk.Stat
+	if children {
+		r.children, stat, r.err = stormConn.Children(path)
+	} else {
+		r.data, stat, r.err = stormConn.Get(path)
+	}
+	observeBackend(stormConn.Server(), time.Since(st), r.err != nil && r.err != zk.ErrNoNode)
+	if stat != nil {
+		r.stat = Stat{
+			Czxid: ZXid(stat.Czxid), Mzxid: ZXid(stat.Mzxid), Ctime: stat.Ctime, Mtime: stat.Mtime,
+			Version: Ver(stat.Version), Cversion: Ver(stat.Cversion), Aversion: Ver(stat.Aversion),
+			EphemeralOwner: Sid(stat.EphemeralOwner), DataLength: stat.DataLength,
+			NumChildren: stat.NumChildren, Pzxid: ZXid(stat.Pzxid),
+		}
+	}
+	stormMu.Lock()
+	r.at = time.Now()
+	stormMu.Unlock()
+	close(r.done)
+}
+
+// seenZxid raises the highest zxid the client has seen to zxid.
+func (s *session) seenZxid(zxid ZXid) {
+	for {
+		seen := atomic.LoadInt64(&s.zxid)
+		if int64(zxid) <= seen || atomic.CompareAndSwapInt64(&s.zxid, seen, int64(zxid)) {
+			return
+		}
+	}
+}
+
+// futureRead serves getData and getChildren, sharing the reads of hot paths.
+func (s *session) futureRead(xid Xid, op Op, path string, watch bool, raw []byte) error {
+	if !isStormHot(path) {
+		return s.future(xid, op, path, raw)
+	}
+	if !s.allowed(op, path) {
+		raw, _ = generateErrResp(xid, errNoAuth)
+		return s.reply(xid, raw)
+	}
+	if shouldFilterChildren(op, path) {
+		s.trackChildren(xid, op, path)
+	}
+	// answers must keep the order of the requests
+	if !s.idle() {
+		return s.forward(xid, op, path, raw)
+	}
+	timeout := stormReadTimeout
+	if deadline := opDeadline(op, time.Now()); !deadline.IsZero() {
+		timeout = time.Until(deadline)
+	}
+	r := sharedRead(op != opGetData, path, timeout)
+	if r == nil || r.err != nil {
+		return s.forward(xid, op, path, raw)
+	}
+	// the client must not see the node older than it has already seen it
+	zxid := r.stat.Mzxid
+	if op != opGetData {
+		zxid = r.stat.Pzxid
+	}
+	if int64(zxid) < atomic.LoadInt64(&s.zxid) {
+		stormStale.Add(1)
+		return s.forward(xid, op, path, raw)
+	}
+	var resp interface{}
+	watches := &SetWatchesRequest{}
+	size := 256
+	switch op {
+	case opGetData:
+		resp = &GetDataResponse{Data: r.data, Stat: r.stat}
+		watches.RelativeZxid, watches.DataWatches = r.stat.Mzxid, []string{path}
+		size += len(r.data)
+	case opGetChildren:
+		resp = &GetChildrenResponse{Children: r.children}
+		watches.RelativeZxid, watches.ChildWatches = r.stat.Pzxid, []string{path}
+	case opGetChildren2:
+		resp = &GetChildren2Response{Children: r.children, Stat: r.stat}
+		watches.RelativeZxid, watches.ChildWatches = r.stat.Pzxid, []string{path}
+	}
+	for _, child := range r.children {
+		size += 4 + len(child)
+	}
+	var wraw []byte
+	if watch {
+		var err error
+		wraw, err = encodeRequest(setWatchesXid, opSetWatches, watches, 64+len(path))
+		if err != nil {
+			glog.Errorf("encode set watches of %s for %d %v", path, int(xid), err)
+			return s.forward(xid, op, path, raw)
+		}
+	}
+	// zxid 0 keeps the client from taking the zxid of another server
+	hdr := &ResponseHeader{Xid: xid, Err: errOk}
+	buf := make([]byte, size)
+	n, err := encodePacket(buf, hdr)
+	if err == nil {
+		var n2 int
+		n2, err = encodePacket(buf[n:], resp)
+		n += n2
+	}
+	if err != nil {
+		glog.Errorf("encode shared read of %s for %d %v", path, int(xid), err)
+		return s.forward(xid, op, path, raw)
+	}
+	// recvLoop sends the response before it takes the next packet of the
+	// server, so no event of the watch can get to the client ahead of it
+	select {
+	case s.local <- s.filterResponse(hdr, buf[:n]):
+	case <-s.ctx.Done():
+		return ErrClosing
+	}
+	if wraw == nil {
+		return nil
+	}
+	return s.forward(setWatchesXid, opSetWatches, path, wraw)
+}
+
+// idle reports whether every forwarded request got its response and every
+// reply of the proxy was sent.
+func (s *session) idle() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending) == 0 && len(s.held) == 0
+}
+
+// trackSetWatches remembers who sent a setWatches. Their responses come back
+// in order, and the ones to requests injected by the proxy are dropped.
+func (s *session) trackSetWatches(injected bool) {
+	s.pendingMu.Lock()
+	s.setWatches = append(s.setWatches, injected)
+	s.pendingMu.Unlock()
+}
+
+func (s *session) injectedSetWatches() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if len(s.setWatches) == 0 {
+		return false
+	}
+	injected := s.setWatches[0]
+	s.setWatches = s.setWatches[1:]
+	return injected
+}
+
+// stormResponse counts the watch events from the zk server and reports
+// whether raw answers a setWatches injected by the proxy and must be dropped.
+func (s *session) stormResponse(hdr *ResponseHeader, raw []byte) bool {
+	switch hdr.Xid {
+	case watchXid:
+		ev := &WatcherEvent{}
+		n, err := decodePacket(raw, &ResponseHeader{})
+		if err == nil {
+			_, err = decodePacket(raw[n:], ev)
+		}
+		if err != nil {
+			glog.Errorf("decode watch event for %s %v", s.sidStr, err)
+			return false
+		}
+		recordWatchEvent(ev.Path)
+	case setWatchesXid:
+		return s.injectedSetWatches()
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package zk
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestSharedReadTimeout(t *testing.T) {
+	saved := stormShare
+	stormShare = time.Minute
+	defer func() { stormShare = saved }()
+	key := stormKey{false, "/storm/test"}
+	inflight := &stormRead{done: make(chan struct{})}
+	stormMu.Lock()
+	stormReads[key] = inflight
+	stormMu.Unlock()
+	defer func() {
+		stormMu.Lock()
+		delete(stormReads, key)
+		stormMu.Unlock()
+	}()
+	if r := sharedRead(false, "/storm/test", 10*time.Millisecond); r != nil {
+		t.Fatalf("shared read in flight returned %+v, want nil after the timeout", r)
+	}
+	inflight.data = []byte("x")
+	stormMu.Lock()
+	inflight.at = time.Now()
+	stormMu.Unlock()
+	close(inflight.done)
+	if r := sharedRead(false, "/storm/test", 10*time.Millisecond); r != inflight {
+		t.Fatalf("shared read returned %+v, want the recent read", r)
+	}
+}
+
+func TestSeenZxid(t *testing.T) {
+	s := &session{zxid: 5}
+	for _, zxid := range []ZXid{3, 9, -1, 7, 12, 0} {
+		s.seenZxid(zxid)
+	}
+	if s.zxid != 12 {
+		t.Fatalf("highest zxid seen %d, want 12", s.zxid)
+	}
+}
+
+func TestFutureReadShared(t *testing.T) {
+	const path = "/storm/shared"
+	savedThreshold, savedShare := stormThreshold, stormShare
+	stormThreshold, stormShare = 1, time.Minute
+	key := stormKey{false, path}
+	r := &stormRead{done: make(chan struct{}), at: time.Now(), data: []byte("x"), stat: Stat{Mzxid: 10}}
+	close(r.done)
+	stormMu.Lock()
+	stormHot[path] = time.Now().Add(time.Minute)
+	stormReads[key] = r
+	stormMu.Unlock()
+	defer func() {
+		stormThreshold, stormShare = savedThreshold, savedShare
+		stormMu.Lock()
+		delete(stormHot, path)
+		delete(stormReads, key)
+		stormMu.Unlock()
+	}()
+	tests := []struct {
+		name   string
+		watch  bool
+		seen   int64
+		client []Xid
+		server []Xid
+	}{
+		{"shared", false, 5, []Xid{1}, []Xid{}},
+		{"shared with a watch", true, 5, []Xid{1, watchXid}, []Xid{setWatchesXid}},
+		{"stale for the session", false, 20, []Xid{}, []Xid{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, zkc := &recordConn{}, &recordClient{readc: make(chan ZKResponse)}
+			// the server fires the watch as soon as it is set
+			zkc.onSend = func(raw []byte) {
+				if len(raw) < 4 || Xid(binary.BigEndian.Uint32(raw)) != setWatchesXid {
+					return
+				}
+				buf := make([]byte, 64)
+				n, _ := encodePacket(buf, &ResponseHeader{Xid: watchXid})
+				n2, _ := encodePacket(buf[n:], &WatcherEvent{Type: EventNodeDataChanged, State: StateSyncConnected, Path: path})
+				go func() {
+					zkc.readc <- ZKResponse{hdr: &ResponseHeader{Xid: watchXid}, raw: buf[:n+n2]}
+				}()
+			}
+			s := newTestSession(t, conn, zkc)
+			s.zxid = tt.seen
+			req, _ := encodeRequest(1, opGetData, &GetDataRequest{Path: path, Watch: tt.watch}, 64)
+			if err := s.futureRead(1, opGetData, path, tt.watch, req); err != nil {
+				t.Fatal(err)
+			}
+			client := waitSent(t, conn, len(tt.client))
+			if len(client) != len(tt.client) {
+				t.Fatalf("client got %v, want %v", client, tt.client)
+			}
+			for i := range client {
+				if client[i] != tt.client[i] {
+					t.Fatalf("client got %v, want %v", client, tt.client)
+				}
+			}
+			server := zkc.xids()
+			if len(server) != len(tt.server) {
+				t.Fatalf("server got %v, want %v", server, tt.server)
+			}
+			for i := range server {
+				if server[i] != tt.server[i] {
+					t.Fatalf("server got %v, want %v", server, tt.server)
+				}
+			}
+		})
+	}
+}
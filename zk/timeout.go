@@ -0,0 +1,122 @@
+package zk
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Forwarded requests not answered by the zk server before their deadline
+// are answered with errOperationTimeout by the proxy, and their responses
+// are dropped if they come after all.
+var (
+	requestTimeout      time.Duration
+	opTimeouts          = make(map[Op]time.Duration)
+	timeoutCheck        = 100 * time.Millisecond
+	requestTimeoutCount = expvar.NewInt("request_timeouts")
+	lateResponseCount   = expvar.NewInt("late_responses")
+)
+
+// SetRequestTimeout sets the deadline of forwarded requests in ms, and of
+// some ops on their own with ops like "Get=500,Create=2000". 0 is no
+// deadline.
+func SetRequestTimeout(ms int, ops string) error {
+	requestTimeout = time.Duration(ms) * time.Millisecond
+	for _, kv := range strings.Split(ops, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("invalid op timeout " + kv)
+		}
+		op, ok := parseOpName(parts[0])
+		if !ok {
+			return errors.New("invalid op " + parts[0])
+		}
+		d, err := strconv.Atoi(parts[1])
+		if err != nil || d < 0 {
+			return errors.New("invalid op timeout " + kv)
+		}
+		opTimeouts[op] = time.Duration(d) * time.Millisecond
+	}
+	glog.V(1).Infof("set request timeout for %v %v", requestTimeout, opTimeouts)
+	return nil
+}
+
+func timeoutEnabled() bool {
+	return requestTimeout > 0 || len(opTimeouts) > 0
+}
+
+// opDeadline returns when a request of op sent at sent times out, or zero.
+func opDeadline(op Op, sent time.Time) time.Time {
+	d, ok := opTimeouts[op]
+	if !ok {
+		d = requestTimeout
+	}
+	if d <= 0 {
+		return time.Time{}
+	}
+	return sent.Add(d)
+}
+
+// expirePending answers the requests past their deadline and remembers them,
+// so their late responses are dropped. The client expects its responses in
+// xid order, so requests only expire as an ordered prefix of the pending ones:
+// a request past its deadline waits while an earlier one is still running.
+// It runs on recvLoop, the path s.local feeds, and sends the replies there
+// directly, in order with the responses of the zk server.
+func (s *session) expirePending(now time.Time) error {
+	s.pendingMu.Lock()
+	xids := make([]Xid, 0, len(s.pending))
+	for xid := range s.pending {
+		xids = append(xids, xid)
+	}
+	sort.Slice(xids, func(i, j int) bool { return xids[i] < xids[j] })
+	expired := []Xid{}
+	for _, xid := range xids {
+		req := s.pending[xid]
+		if req.deadline.IsZero() || now.Before(req.deadline) {
+			break
+		}
+		delete(s.pending, xid)
+		if req.slot {
+			sched.release(s.backend)
+		}
+		s.late[xid] = true
+		expired = append(expired, xid)
+		observeBackend(s.backend, now.Sub(req.sent), true)
+		glog.Warningf("request %d of %s %s to %s timeout after %v", int(xid), s.sidStr, opName(req.op), s.serverAddress, now.Sub(req.sent))
+	}
+	s.pendingMu.Unlock()
+	for _, xid := range expired {
+		requestTimeoutCount.Add(1)
+		s.filterMu.Lock()
+		delete(s.filters, xid)
+		s.filterMu.Unlock()
+		raw, _ := generateErrResp(xid, errOperationTimeout)
+		if _, err := s.Send(raw); err != nil {
+			glog.Errorf("send timeout to client for %d %v", int(xid), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// lateResponse reports whether the response to xid comes after the request
+// was answered with a timeout.
+func (s *session) lateResponse(xid Xid) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if !s.late[xid] {
+		return false
+	}
+	delete(s.late, xid)
+	lateResponseCount.Add(1)
+	return true
+}
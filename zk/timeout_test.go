@@ -0,0 +1,88 @@
+package zk
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordConn is a client connection keeping what is sent to it.
+type recordConn struct {
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (c *recordConn) Send(resp []byte) (int, error) {
+	c.mu.Lock()
+	c.sent = append(c.sent, resp)
+	c.mu.Unlock()
+	return len(resp), nil
+}
+func (c *recordConn) Read() <-chan ZKRequest { return nil }
+func (c *recordConn) Close()                 {}
+func (c *recordConn) RemoteAddress() string  { return "10.0.0.1:4000" }
+
+func (c *recordConn) xids() []Xid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	xids := make([]Xid, 0, len(c.sent))
+	for _, raw := range c.sent {
+		xids = append(xids, Xid(binary.BigEndian.Uint32(raw)))
+	}
+	return xids
+}
+
+func TestExpirePendingInOrder(t *testing.T) {
+	const past, future, none = -time.Second, time.Second, time.Duration(0)
+	tests := []struct {
+		name      string
+		deadlines map[Xid]time.Duration // from now, none for no deadline
+		replies   []Xid
+		left      int
+	}{
+		{"all expired", map[Xid]time.Duration{7: past, 3: past, 5: past, 4: past, 6: past}, []Xid{3, 4, 5, 6, 7}, 0},
+		{"earlier still running", map[Xid]time.Duration{1: past, 2: future, 3: past}, []Xid{1}, 2},
+		{"earlier without deadline", map[Xid]time.Duration{4: none, 5: past}, []Xid{}, 2},
+		{"later still running", map[Xid]time.Duration{8: past, 9: past, 10: future}, []Xid{8, 9}, 1},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		c := &recordConn{}
+		s := &session{
+			Conn:    c,
+			pending: make(map[Xid]pendingReq),
+			late:    make(map[Xid]bool),
+			filters: make(map[Xid]childrenFilter),
+		}
+		for xid, d := range tt.deadlines {
+			req := pendingReq{op: opGetData, sent: now.Add(-2 * time.Second)}
+			if d != none {
+				req.deadline = now.Add(d)
+			}
+			s.pending[xid] = req
+		}
+		if err := s.expirePending(now); err != nil {
+			t.Fatal(err)
+		}
+		got := c.xids()
+		if len(got) != len(tt.replies) {
+			t.Errorf("%s: replied %v, want %v", tt.name, got, tt.replies)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.replies[i] {
+				t.Errorf("%s: replied %v, want %v", tt.name, got, tt.replies)
+				break
+			}
+		}
+		for _, xid := range tt.replies {
+			if !s.lateResponse(xid) {
+				t.Errorf("%s: response of %d not dropped as late", tt.name, xid)
+			}
+		}
+		if len(s.pending) != tt.left {
+			t.Errorf("%s: %d requests pending, want %d", tt.name, len(s.pending), tt.left)
+		}
+	}
+}
@@ -5,21 +5,21 @@ import (
 )
 
 type ZK interface {
-	Create(xid Xid, path string, raw []byte) error
+	Create(xid Xid, req *CreateRequest, raw []byte) error
 	Delete(xid Xid, path string, raw []byte) error
 	Exists(xid Xid, path string, raw []byte) error
-	GetData(xid Xid, path string, raw []byte) error
+	GetData(xid Xid, req *GetDataRequest, raw []byte) error
 	SetData(xid Xid, path string, raw []byte) error
 	GetAcl(xid Xid, path string, raw []byte) error
-	SetAcl(xid Xid, path string, raw []byte) error
-	GetChildren(xid Xid, path string, raw []byte) error
+	SetAcl(xid Xid, req *SetAclRequest, raw []byte) error
+	GetChildren(xid Xid, req *GetChildrenRequest, raw []byte) error
 	Sync(xid Xid, path string, raw []byte) error
 	Ping(xid Xid, path string, raw []byte) error
-	GetChildren2(xid Xid, path string, raw []byte) error
-	Multi(xid Xid, path string, raw []byte) error
+	GetChildren2(xid Xid, req *GetChildren2Request, raw []byte) error
+	Multi(xid Xid, req *MultiRequest, raw []byte) error
 	Close(xid Xid, path string, raw []byte) error
 	SetAuth(xid Xid, path string, raw []byte) error
-	SetWatches(xid Xid, path string, raw []byte) error
+	SetWatches(xid Xid, req *SetWatchesRequest, raw []byte) error
 }
 
 type zkZK struct{ s *session }
@@ -28,66 +28,66 @@ func newZK(s Session) ZK {
 	return &zkZK{s.(*session)}
 }
 
-func (zz *zkZK) Create(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) Create(xid Xid, req *CreateRequest, raw []byte) error {
+	return zz.s.futureAcl(xid, opCreate, req.Path, req.Acl, raw)
 }
 func (zz *zkZK) Delete(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opDelete, path, raw)
 }
 func (zz *zkZK) Exists(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opExists, path, raw)
 }
-func (zz *zkZK) GetData(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) GetData(xid Xid, req *GetDataRequest, raw []byte) error {
+	return zz.s.futureRead(xid, opGetData, req.Path, req.Watch, raw)
 }
 func (zz *zkZK) SetData(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opSetData, path, raw)
 }
 func (zz *zkZK) GetAcl(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opGetAcl, path, raw)
 }
-func (zz *zkZK) SetAcl(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) SetAcl(xid Xid, req *SetAclRequest, raw []byte) error {
+	return zz.s.futureAcl(xid, opSetAcl, req.Path, req.Acl, raw)
 }
-func (zz *zkZK) GetChildren(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) GetChildren(xid Xid, req *GetChildrenRequest, raw []byte) error {
+	return zz.s.futureRead(xid, opGetChildren, req.Path, req.Watch, raw)
 }
 func (zz *zkZK) Sync(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opSync, path, raw)
 }
 func (zz *zkZK) Ping(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opPing, path, raw)
 }
-func (zz *zkZK) GetChildren2(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) GetChildren2(xid Xid, req *GetChildren2Request, raw []byte) error {
+	return zz.s.futureRead(xid, opGetChildren2, req.Path, req.Watch, raw)
 }
-func (zz *zkZK) Multi(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) Multi(xid Xid, req *MultiRequest, raw []byte) error {
+	return zz.s.futureMulti(xid, req, raw)
 }
 func (zz *zkZK) Close(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opClose, path, raw)
 }
 func (zz *zkZK) SetAuth(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+	return zz.s.future(xid, opSetAuth, path, raw)
 }
-func (zz *zkZK) SetWatches(xid Xid, path string, raw []byte) error {
-	return zz.s.future(xid, path, raw)
+func (zz *zkZK) SetWatches(xid Xid, req *SetWatchesRequest, raw []byte) error {
+	return zz.s.futureSetWatches(xid, req, raw)
 }
 
 func DispatchZK(zk ZK, xid Xid, op interface{}, raw []byte) (string, string, error) {
 	switch op := op.(type) {
 	case *CreateRequest:
-		return "Create", op.Path, zk.Create(xid, op.Path, raw)
+		return "Create", op.Path, zk.Create(xid, op, raw)
 	case *DeleteRequest:
 		return "Delete", op.Path, zk.Delete(xid, op.Path, raw)
 	case *GetChildrenRequest:
-		return "GetChildren", op.Path, zk.GetChildren(xid, op.Path, raw)
+		return "GetChildren", op.Path, zk.GetChildren(xid, op, raw)
 	case *GetChildren2Request:
-		return "GetChildren2", op.Path, zk.GetChildren2(xid, op.Path, raw)
+		return "GetChildren2", op.Path, zk.GetChildren2(xid, op, raw)
 	case *PingRequest:
 		return "Ping", "", zk.Ping(xid, "", raw)
 	case *GetDataRequest:
-		return "Get", op.Path, zk.GetData(xid, op.Path, raw)
+		return "Get", op.Path, zk.GetData(xid, op, raw)
 	case *SetDataRequest:
 		return "Set", op.Path, zk.SetData(xid, op.Path, raw)
 	case *ExistsRequest:
@@ -97,17 +97,17 @@ func DispatchZK(zk ZK, xid Xid, op interface{}, raw []byte) (string, string, err
 	case *CloseRequest:
 		return "Close", "", zk.Close(xid, "", raw)
 	case *SetWatchesRequest:
-		return "SetWatches", "", zk.SetWatches(xid, "", raw)
+		return "SetWatches", "", zk.SetWatches(xid, op, raw)
 	case *MultiRequest:
-		return "Multi", "", zk.Multi(xid, "", raw)
+		return "Multi", "", zk.Multi(xid, op, raw)
 	case *GetAclRequest:
 		return "GetAcl", op.Path, zk.GetAcl(xid, op.Path, raw)
 	case *SetAclRequest:
-		return "SetAcl", op.Path, zk.SetAcl(xid, op.Path, raw)
+		return "SetAcl", op.Path, zk.SetAcl(xid, op, raw)
 	case *SetAuthRequest:
 		return "SetAuth", "", zk.SetAuth(xid, "", raw)
 	default:
-		glog.Errorf("unexpected type %d %T\n", xid, op, raw)
+		glog.Errorf("unexpected type %d %T\n", xid, op)
 	}
 	return "Unknown", "", ErrAPIError
 }